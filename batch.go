@@ -0,0 +1,110 @@
+package hydrate
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+//KeysPlaceholder is replaced with the keys of a batch in the statement of a batch query
+const KeysPlaceholder = "{{keys}}"
+
+//DefaultBatchSize is the number of keys bound by each statement of a batch query when no size is given
+const DefaultBatchSize = 1000
+
+//batchConfiguration defines the items a batch query loads for
+type batchConfiguration struct {
+	//parent is an example of the type of the items whose keys are loaded for
+	parent interface{}
+	//fields are the fields of parent holding each key
+	fields []string
+	//size is the maximum number of keys bound by a single statement
+	size int
+}
+
+//Batch will set the query to load items for the keys of parent items already loaded by earlier queries of a
+//MultiQuery, instead of running once. fields are the fields of the parent type holding each key, and every distinct
+//non-null key is bound in place of KeysPlaceholder, which is run as many statements as needed to hold at most size keys
+//each (or DefaultBatchSize if size is less than 1). A single field is bound as a list of values and multiple fields as
+//a list of tuples, so the placeholder is used within IN. Keys are bound after all other args, so the placeholder must
+//follow every other placeholder. Items loaded by every batch are merged into the same identity maps as the rest of the
+//MultiQuery, and if no parent items have been loaded no statement is run.
+//	NewQuery(db, `FROM sections s WHERE s.textbook_id IN ({{keys}}) ORDER BY s.section_id`).
+//		AddModel(Section{}, "s").
+//		Batch(Textbook{}, 500, "TextbookID")
+func (r Query) Batch(parent interface{}, size int, fields ...string) Query {
+	if size < 1 {
+		size = DefaultBatchSize
+	}
+	r.batch = &batchConfiguration{parent: parent, fields: fields, size: size}
+
+	return r
+}
+
+//batches will return a query for each batch of keys held by the items of parents
+func (r Query) batches(parents *modelLoader) ([]Query, error) {
+	if strings.Count(r.query, KeysPlaceholder) != 1 {
+		return nil, fmt.Errorf("batch query must have a single %s placeholder", KeysPlaceholder)
+	}
+	if len(r.batch.fields) == 0 {
+		return nil, fmt.Errorf("batch query has no key fields")
+	}
+	for _, name := range r.batch.fields {
+		if _, ok := parents.itemType.FieldByName(name); !ok {
+			return nil, fmt.Errorf("%s has no field %s", parents.itemType, name)
+		}
+	}
+
+	var keys [][]interface{}
+	storedKeys := make(map[key]struct{}, len(parents.items))
+	for _, item := range parents.items {
+		itemVal := reflect.ValueOf(item).Elem()
+		k, ok, err := fieldsKey(itemVal, r.batch.fields)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			//null never matches
+			continue
+		}
+		if _, ok := storedKeys[k]; ok {
+			continue
+		}
+		storedKeys[k] = struct{}{}
+
+		vals := make([]interface{}, 0, len(r.batch.fields))
+		for _, name := range r.batch.fields {
+			val := itemVal.FieldByName(name)
+			for val.Kind() == reflect.Ptr {
+				val = val.Elem()
+			}
+			vals = append(vals, val.Interface())
+		}
+		keys = append(keys, vals)
+	}
+
+	placeholder := "?"
+	if len(r.batch.fields) > 1 {
+		placeholder = "(" + strings.TrimSuffix(strings.Repeat("?,", len(r.batch.fields)), ",") + ")"
+	}
+
+	ret := make([]Query, 0, (len(keys)+r.batch.size-1)/r.batch.size)
+	for start := 0; start < len(keys); start += r.batch.size {
+		end := start + r.batch.size
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		q := r
+		q.batch = nil
+		q.args = make([]interface{}, 0, len(r.args)+(end-start)*len(r.batch.fields))
+		q.args = append(q.args, r.args...)
+		for _, vals := range keys[start:end] {
+			q.args = append(q.args, vals...)
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat(placeholder+",", end-start), ",")
+		q.query = strings.Replace(r.query, KeysPlaceholder, placeholders, 1)
+		ret = append(ret, q)
+	}
+	return ret, nil
+}
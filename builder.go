@@ -0,0 +1,448 @@
+package hydrate
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+//RootAlias is the alias of the root model in the statement of a Builder
+const RootAlias = "t"
+
+//Builder will build a Query loading a model and any of its relationships given as preload-style paths, deriving table
+//names, aliases and join conditions from the metadata of each model. The root model is aliased RootAlias and each
+//relationship is aliased with the alias of its parent and the snake case of the relationship name, ie. joining
+//"Sections.Exercises" from a Textbook aliases sections as t_sections and exercises as t_sections_exercises. The join
+//table of a many2many relationship is aliased with the relationship alias followed by _join.
+type Builder struct {
+	provider Provider
+	executor Executor
+	model    interface{}
+
+	paths  []string
+	wheres []string
+	args   []interface{}
+}
+
+//From will create a builder loading the model given using gorm
+func From(db *gorm.DB, model interface{}) Builder {
+	return FromWith(gormProvider{}, gormExecutor{db}, model)
+}
+
+//FromWith will create a builder loading the model given using a provider and executor, as with NewQueryWith
+func FromWith(provider Provider, executor Executor, model interface{}) Builder {
+	return Builder{provider: provider, executor: executor, model: model}
+}
+
+//Join will add a relationship to load, given as a path of relationship names separated by dots (ie.
+//"Sections.Exercises"). All relationships along the path are loaded.
+func (b Builder) Join(path string) Builder {
+	//cap the slice so builders branched from the same builder never share an array
+	b.paths = append(b.paths[:len(b.paths):len(b.paths)], path)
+
+	return b
+}
+
+//Where will add a condition to the statement using the aliases of the builder. All conditions must be met.
+func (b Builder) Where(query string, args ...interface{}) Builder {
+	b.wheres = append(b.wheres[:len(b.wheres):len(b.wheres)], query)
+	b.args = append(b.args[:len(b.args):len(b.args)], args...)
+
+	return b
+}
+
+//Run will build the query and run it, as with Query.Run
+func (b Builder) Run(ctx context.Context, output ...interface{}) error {
+	q, err := b.Query()
+	if err != nil {
+		return err
+	}
+	return q.Run(ctx, output...)
+}
+
+//RunResult will build the query and run it, as with Query.RunResult
+func (b Builder) RunResult(ctx context.Context) (*Result, error) {
+	q, err := b.Query()
+	if err != nil {
+		return nil, err
+	}
+
+	return q.RunResult(ctx)
+}
+
+//Query will build the query. Each relationship is left joined to its parent and rows are ordered by the primary key
+//of each model in the order they were joined. The root alias is used as the root of the query, so outputs of the root
+//type only hold items matching the conditions of the builder.
+func (b Builder) Query() (Query, error) {
+	root, err := b.resolve()
+	if err != nil {
+		return Query{}, err
+	}
+
+	var nodes []plannedNode
+	root.walk(func(n *joinNode) bool {
+		nodes = append(nodes, plannedNode{joinNode: n, load: true})
+		return true
+	})
+	return b.build(nodes)
+}
+
+//Plan will build a MultiQuery loading the same hierarchy as Query without multiplying rows of sibling relationships.
+//The first query loads the root model joined with all has one and belongs to relationships, and each has many and
+//many2many relationship is loaded by its own query joining down from the root, along with all of its own has one and
+//belongs to relationships. As all queries select from the root model, conditions given to Where should only use the
+//root alias. The queries are independent so the plan can be run using RunParallel.
+func (b Builder) Plan() (MultiQuery, error) {
+	root, err := b.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	var ret MultiQuery
+	for _, nodes := range root.branches(false) {
+		q, err := b.build(nodes)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, q)
+	}
+	return ret, nil
+}
+
+//Union will build a single Query loading the same branches as Plan, selected by one UNION ALL statement. Each branch
+//selects the columns of every model, joining the models of other branches without matching any rows so their columns
+//are NULL, along with BranchColumn so each row is only loaded into the models of its branch. The models joined from the
+//root to a relationship are also loaded by its branch to order its rows. As with Plan, conditions given to Where
+//should only use the root alias.
+func (b Builder) Union() (Query, error) {
+	root, err := b.resolve()
+	if err != nil {
+		return Query{}, err
+	}
+
+	var all []*joinNode
+	root.walk(func(n *joinNode) bool {
+		all = append(all, n)
+		return true
+	})
+
+	q := NewQueryWith(b.provider, b.executor, "").AsRoot(RootAlias)
+	models := make(map[string]int)
+	joinTables := make(map[string]int)
+	for _, nodes := range root.branches(true) {
+		var branch queryBranch
+		joined := make(map[*joinNode]struct{}, len(nodes))
+		for _, n := range nodes {
+			joined[n.joinNode] = struct{}{}
+
+			//a model is only added once, and shares its columns with all branches loading it
+			m, ok := models[n.alias]
+			if !ok {
+				m = len(q.models)
+				models[n.alias] = m
+				q = q.AddModel(n.example(), n.alias)
+			}
+			branch.models = append(branch.models, m)
+
+			if n.join == nil {
+				continue
+			}
+			j, ok := joinTables[n.alias]
+			if !ok {
+				j = len(q.joinTables)
+				joinTables[n.alias] = j
+				q = q.AddJoinTable(n.parent.example(), n.rel.Field, n.joinAlias())
+			}
+			branch.joinTables = append(branch.joinTables, j)
+		}
+		for _, n := range all {
+			if _, ok := joined[n]; !ok {
+				nodes = append(nodes, plannedNode{joinNode: n, pad: true})
+			}
+		}
+
+		from, _, err := b.from(nodes)
+		if err != nil {
+			return Query{}, err
+		}
+		branch.query, branch.args = from+b.where(), b.args
+		q.branches = append(q.branches, branch)
+	}
+
+	return q, nil
+}
+
+//branches will return the nodes joined by each query of a plan. The first branch joins the root and all nodes joined
+//to it by single item relationships, and every other branch joins down from the root to a relationship to many items
+//along with all nodes joined to it by single item relationships. The nodes along the path from the root are only
+//loaded if loadPath is set.
+func (n *joinNode) branches(loadPath bool) [][]plannedNode {
+	//inline will add the node and all nodes joined to it by a single item relationship
+	inline := func(n *joinNode, nodes []plannedNode) []plannedNode {
+		n.walk(func(c *joinNode) bool {
+			if c != n && c.toMany() {
+				return false
+			}
+			nodes = append(nodes, plannedNode{joinNode: c, load: true, inner: c == n && c.parent != nil})
+			return true
+		})
+		return nodes
+	}
+
+	ret := [][]plannedNode{inline(n, nil)}
+	n.walk(func(c *joinNode) bool {
+		if !c.toMany() {
+			return true
+		}
+
+		//join down from the root to the relationship, the models along the way are also loaded by other branches
+		var path []plannedNode
+		for p := c.parent; p != nil; p = p.parent {
+			path = append([]plannedNode{{joinNode: p, load: loadPath, inner: p.parent != nil}}, path...)
+		}
+		ret = append(ret, inline(c, path))
+		return true
+	})
+	return ret
+}
+
+//plannedNode is a node joined by a query being built
+type plannedNode struct {
+	*joinNode
+	//load is set if the model of the node is loaded by the query
+	load bool
+	//inner is set to inner join the node to its parent instead of a left join
+	inner bool
+	//pad is set to join the node without matching any rows, so the columns of a model loaded by other branches of a
+	//union are NULL
+	pad bool
+}
+
+//build will build a query joining the nodes given, which must be in order with parents before their children, and
+//ordering rows by the primary key of each node
+func (b Builder) build(nodes []plannedNode) (Query, error) {
+	from, orders, err := b.from(nodes)
+	if err != nil {
+		return Query{}, err
+	}
+	from += b.where()
+	if len(orders) > 0 {
+		from = fmt.Sprintf("%s ORDER BY %s", from, strings.Join(orders, ", "))
+	}
+
+	q := NewQueryWith(b.provider, b.executor, from, b.args...)
+	if nodes[0].load {
+		//items of the root type are only output for the rows of the root, not where they're joined as relationships
+		q = q.AsRoot(RootAlias)
+	}
+	for _, n := range nodes {
+		if !n.load {
+			continue
+		}
+		q = q.AddModel(n.example(), n.alias)
+		if n.join != nil {
+			q = q.AddJoinTable(n.parent.example(), n.rel.Field, n.joinAlias())
+		}
+	}
+	return q, nil
+}
+
+//from will return the FROM clause joining the nodes given, and the primary key of each node to order by
+func (b Builder) from(nodes []plannedNode) (string, []string, error) {
+	var sb strings.Builder
+	var orders []string
+	fmt.Fprintf(&sb, "FROM %s %s", nodes[0].metadata.tableName(b.executor), nodes[0].alias)
+	for _, n := range nodes {
+		for _, f := range n.metadata.keyFields {
+			orders = append(orders, fmt.Sprintf("%s.%s", n.alias, f.Column))
+		}
+		if n.pad {
+			sb.WriteString(" ")
+			sb.WriteString(n.padStatement(b.executor))
+			continue
+		}
+		if n.parent == nil {
+			continue
+		}
+
+		j, err := n.joinStatement(b.executor, n.inner)
+		if err != nil {
+			return "", nil, err
+		}
+		sb.WriteString(" ")
+		sb.WriteString(j)
+	}
+
+	return sb.String(), orders, nil
+}
+
+//where will return the WHERE clause of all conditions given to Where
+func (b Builder) where() string {
+	if len(b.wheres) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" WHERE (%s)", strings.Join(b.wheres, ") AND ("))
+}
+
+//resolve will resolve all paths of the builder into a tree of joined relationships
+func (b Builder) resolve() (*joinNode, error) {
+	metadata, err := getModelMetadata(b.provider, b.model)
+	if err != nil {
+		return nil, err
+	}
+	root := &joinNode{alias: RootAlias, metadata: metadata}
+
+	for _, path := range b.paths {
+		n := root
+		for _, name := range strings.Split(path, ".") {
+			if n, err = n.child(b.provider, name); err != nil {
+				return nil, fmt.Errorf("join %s: %w", path, err)
+			}
+		}
+	}
+
+	return root, nil
+}
+
+//joinNode is a model joined by a Builder, along with the relationship joining it to its parent
+type joinNode struct {
+	alias    string
+	metadata *modelMetadata
+
+	parent   *joinNode
+	rel      *relationshipMetadata
+	join     *joinTableMetadata
+	children []*joinNode
+}
+
+//example will return an example of the model of the node
+func (n *joinNode) example() interface{} {
+	return reflect.New(n.metadata.itemType).Interface()
+}
+
+//joinAlias will return the alias of the join table of a many2many relationship
+func (n *joinNode) joinAlias() string {
+	return n.alias + "_join"
+}
+
+//child will return the node joining the relationship with the given name, adding it if it's not already joined
+func (n *joinNode) child(provider Provider, name string) (*joinNode, error) {
+	for _, c := range n.children {
+		if c.rel.Field == name {
+			return c, nil
+		}
+	}
+
+	var rel *relationshipMetadata
+	for i, r := range n.metadata.relationships {
+		if r.Field == name {
+			rel = &n.metadata.relationships[i]
+			break
+		}
+	}
+	if rel == nil {
+		return nil, fmt.Errorf("%s has no relationship %s", n.metadata.itemType, name)
+	}
+
+	metadata, err := getModelMetadata(provider, reflect.New(rel.relatedType).Interface())
+	if err != nil {
+		return nil, err
+	}
+	c := &joinNode{
+		alias:    fmt.Sprintf("%s_%s", n.alias, snakeCase(name)),
+		metadata: metadata,
+		parent:   n,
+		rel:      rel,
+	}
+	if rel.Kind == ManyToMany {
+		if c.join, err = getJoinTableMetadata(provider, n.example(), name); err != nil {
+			return nil, err
+		}
+	}
+
+	n.children = append(n.children, c)
+	return c, nil
+}
+
+//toMany will report whether the node is joined by a relationship to many items
+func (n *joinNode) toMany() bool {
+	return n.rel != nil && (n.rel.Kind == HasMany || n.rel.Kind == ManyToMany)
+}
+
+//walk will call fn for the node and all nodes joined to it, parents before children. Nodes joined to a node are
+//skipped if fn returns false for it.
+func (n *joinNode) walk(fn func(*joinNode) bool) {
+	if !fn(n) {
+		return
+	}
+	for _, c := range n.children {
+		c.walk(fn)
+	}
+}
+
+//joinStatement will return the statement joining the node to its parent, using a left join unless inner is set
+func (n *joinNode) joinStatement(e Executor, inner bool) (string, error) {
+	table := n.metadata.tableName(e)
+	join := "LEFT JOIN"
+	if inner {
+		join = "JOIN"
+	}
+
+	if n.join != nil {
+		//join the join table to the parent, then the node to the join table
+		joinAlias := n.joinAlias()
+		sources := n.join.columns[:len(n.join.sourceFields)]
+		destinations := n.join.columns[len(n.join.sourceFields):]
+
+		parentOn, err := onConditions(joinAlias, sources, n.parent, n.rel.AssociationFields)
+		if err != nil {
+			return "", err
+		}
+		on, err := onConditions(joinAlias, destinations, n, n.rel.ForeignFields)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %s %s ON %s %s %s %s ON %s",
+			join, n.join.getAlias(e, ""), joinAlias, parentOn, join, table, n.alias, on), nil
+	}
+
+	foreignColumns := make([]string, 0, len(n.rel.ForeignFields))
+	for _, name := range n.rel.ForeignFields {
+		column, ok := n.metadata.column(name)
+		if !ok {
+			return "", fmt.Errorf("%s has no column for field %s", n.metadata.itemType, name)
+		}
+		foreignColumns = append(foreignColumns, column)
+	}
+	on, err := onConditions(n.alias, foreignColumns, n.parent, n.rel.AssociationFields)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s %s ON %s", join, table, n.alias, on), nil
+}
+
+//padStatement will return the JOIN clause of the node, and its join table, matching no rows. Unlike NULL this keeps the
+//types of its columns, which a union would otherwise take from other branches.
+func (n *joinNode) padStatement(e Executor) string {
+	pad := fmt.Sprintf("LEFT JOIN %s %s ON 1 = 0", n.metadata.tableName(e), n.alias)
+	if n.join != nil {
+		pad = fmt.Sprintf("LEFT JOIN %s %s ON 1 = 0 %s", n.join.getAlias(e, ""), n.joinAlias(), pad)
+	}
+	return pad
+}
+
+//onConditions will return the conditions matching the columns of an alias to the fields of a node
+func onConditions(alias string, columns []string, n *joinNode, fields []string) (string, error) {
+	conditions := make([]string, 0, len(columns))
+	for i, name := range fields {
+		column, ok := n.metadata.column(name)
+		if !ok {
+			return "", fmt.Errorf("%s has no column for field %s", n.metadata.itemType, name)
+		}
+		conditions = append(conditions, fmt.Sprintf("%s.%s = %s.%s", alias, columns[i], n.alias, column))
+	}
+	return strings.Join(conditions, " AND "), nil
+}
@@ -0,0 +1,51 @@
+package hydrate
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+//ScanError is returned when a column selected for a model can not be scanned into its struct field
+type ScanError struct {
+	//Alias is the alias the column was selected from
+	Alias string
+	//Model is the name of the model type the field belongs to
+	Model string
+	//Field is the name of the struct field the column is scanned into
+	Field string
+	//Column is the name of the column selected
+	Column string
+	//Err is the error returned when scanning the column
+	Err error
+}
+
+func (e *ScanError) Error() string {
+	return fmt.Sprintf("can not scan %s.%s into %s.%s: %v", e.Alias, e.Column, e.Model, e.Field, e.Err)
+}
+
+//Unwrap will return the error returned when scanning the column
+func (e *ScanError) Unwrap() error {
+	return e.Err
+}
+
+//newScanError will find the column of a row that can not be scanned and return a ScanError for it. columns must hold
+//a ScanError describing each value in scans. If no single column fails err is returned as is.
+func newScanError(rows *sql.Rows, scans []interface{}, columns []ScanError, err error) error {
+	//scan one column at a time into its value, discarding all other columns
+	dest := make([]interface{}, len(scans))
+	for i := range dest {
+		dest[i] = new(interface{})
+	}
+	for i := range scans {
+		discard := dest[i]
+		dest[i] = scans[i]
+		if scanErr := rows.Scan(dest...); scanErr != nil {
+			ret := columns[i]
+			ret.Err = scanErr
+			return &ret
+		}
+		dest[i] = discard
+	}
+
+	return err
+}
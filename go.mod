@@ -1,9 +1,20 @@
 module github.com/coursehero/hydrate
 
-go 1.13
+go 1.18
 
 require (
-	github.com/go-sql-driver/mysql v1.4.1
+	github.com/go-sql-driver/mysql v1.7.0
 	github.com/jinzhu/gorm v1.9.12
+	github.com/jinzhu/inflection v1.0.0
 	github.com/stretchr/testify v1.4.0
+	gorm.io/driver/mysql v1.5.7
+	gorm.io/gorm v1.25.12
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/jinzhu/now v1.1.5 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	gopkg.in/yaml.v2 v2.2.2 // indirect
 )
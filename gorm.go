@@ -0,0 +1,161 @@
+package hydrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+
+	"github.com/jinzhu/gorm"
+)
+
+//gormProvider is the default Provider, loading the metadata of models from jinzhu/gorm
+type gormProvider struct{}
+
+//Model will return the metadata of a model from its gorm.ModelStruct
+func (gormProvider) Model(t reflect.Type) (*Model, error) {
+	ms := getModelStruct(t)
+
+	ret := Model{Type: ms.ModelType}
+	for _, f := range ms.StructFields {
+		if f.Relationship != nil {
+			//track all relationships so we can map them later
+			r, err := gormRelationship(ms, f)
+			if err != nil {
+				return nil, err
+			}
+			ret.Relationships = append(ret.Relationships, r)
+		}
+
+		if !f.IsNormal {
+			//if it's not a relationship and not a normal field we don't care about it
+			continue
+		}
+
+		ret.Fields = append(ret.Fields, Field{
+			Name:       f.Name,
+			Column:     f.DBName,
+			Type:       f.Struct.Type,
+			PrimaryKey: f.IsPrimaryKey,
+		})
+	}
+
+	return &ret, nil
+}
+
+//gormRelationship will convert the gorm relationship of a field
+func gormRelationship(ms *gorm.ModelStruct, f *gorm.StructField) (Relationship, error) {
+	rel := f.Relationship
+	ret := Relationship{
+		Field: f.Name,
+		Kind:  RelationshipKind(rel.Kind),
+		//gorm holds the fields of the related model as foreign fields, and fields of our model as association fields
+		ForeignFields:     rel.ForeignFieldNames,
+		AssociationFields: rel.AssociationForeignFieldNames,
+	}
+
+	switch ret.Kind {
+	case BelongsTo:
+		//a belongs_to relationship holds the foreign key on our model instead
+		ret.ForeignFields, ret.AssociationFields = rel.AssociationForeignFieldNames, rel.ForeignFieldNames
+	case ManyToMany:
+		//gorm records the db names of the fields referenced by the join table, map them back to the struct fields so
+		//we know which values to link on. The table is resolved by the gormExecutor as it depends on the db.
+		ret.JoinTable = &JoinTable{}
+		ret.ForeignFields, ret.AssociationFields = nil, nil
+
+		for i, name := range rel.ForeignFieldNames {
+			field, ok := fieldByDBName(ms, name)
+			if !ok {
+				return Relationship{}, fmt.Errorf("%s has no field for column %s", ms.ModelType, name)
+			}
+			ret.AssociationFields = append(ret.AssociationFields, field.Name)
+			ret.JoinTable.SourceColumns = append(ret.JoinTable.SourceColumns, rel.ForeignDBNames[i])
+		}
+		destination := getModelStruct(baseType(f.Struct.Type))
+		for i, name := range rel.AssociationForeignFieldNames {
+			field, ok := fieldByDBName(destination, name)
+			if !ok {
+				return Relationship{}, fmt.Errorf("%s has no field for column %s", destination.ModelType, name)
+			}
+			ret.ForeignFields = append(ret.ForeignFields, field.Name)
+			ret.JoinTable.DestinationColumns = append(ret.JoinTable.DestinationColumns, rel.AssociationForeignDBNames[i])
+		}
+	}
+
+	return ret, nil
+}
+
+//getModelStruct will return the gorm.ModelStruct of a type
+func getModelStruct(t reflect.Type) *gorm.ModelStruct {
+	return (&gorm.Scope{Value: reflect.New(t).Interface()}).GetModelStruct()
+}
+
+//fieldByDBName will return the normal field of a gorm.ModelStruct with the given db name
+func fieldByDBName(ms *gorm.ModelStruct, name string) (*gorm.StructField, bool) {
+	for _, f := range ms.StructFields {
+		if f.IsNormal && f.DBName == name {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+//gormExecutor is the default Executor, running statements on the connection of a gorm.DB
+type gormExecutor struct {
+	db *gorm.DB
+}
+
+//QueryContext will run a raw query on the connection held by db using the context provided. If the context can never
+//be done the query is run with db.Raw(...).Rows() so gorm's row query callbacks and logging are used as normal. gorm's
+//callbacks can't take a context, so otherwise the statement is built as gorm's row query callback builds it, including
+//the gorm:query_hint and gorm:query_option settings, and run directly on the connection. In both cases args are bound
+//exactly as they would be with db.Raw (ie. slices are expanded for IN (?)).
+func (e gormExecutor) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	if e.db.Error != nil {
+		return nil, e.db.Error
+	}
+	if ctx.Done() == nil {
+		return e.db.Raw(query, args...).Rows()
+	}
+
+	scope := e.db.Raw(query, args...).NewScope(nil)
+	scope.Raw(scope.CombinedConditionSql())
+	if str, ok := scope.Get("gorm:query_hint"); ok {
+		scope.SQL = fmt.Sprint(str) + scope.SQL
+	}
+	if str, ok := scope.Get("gorm:query_option"); ok && fmt.Sprint(str) != "" {
+		scope.SQL += " " + fmt.Sprint(str)
+	}
+
+	conn := e.db.CommonDB()
+	if q, ok := conn.(contextQueryer); ok {
+		return q.QueryContext(ctx, scope.SQL, scope.SQLVars...)
+	}
+
+	//the connection can't take a context, at least don't start a query that is already canceled
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return conn.Query(scope.SQL, scope.SQLVars...)
+}
+
+//tableName will return the table name of a model for the db
+func (e gormExecutor) tableName(m *Model) string {
+	return getModelStruct(m.Type).TableName(e.db)
+}
+
+//joinTableName will return the table name of the join table of a many2many relationship for the db
+func (e gormExecutor) joinTableName(m *Model, relationship string) string {
+	for _, f := range getModelStruct(m.Type).StructFields {
+		if f.Name == relationship && f.Relationship != nil && f.Relationship.JoinTableHandler != nil {
+			return f.Relationship.JoinTableHandler.Table(e.db)
+		}
+	}
+	return ""
+}
+
+//contextQueryer is implemented by *sql.DB and *sql.Tx to run queries honoring a context
+type contextQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
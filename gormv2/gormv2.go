@@ -0,0 +1,168 @@
+//Package gormv2 provides hydrate queries for models defined with gorm.io/gorm. Metadata is loaded from gorm's
+//schema.Schema, using the naming strategy of the db so table and column names match those used by gorm, and fields
+//using a serializer are decoded as gorm would. Queries are hydrate.Query values, so they can be combined in a
+//hydrate.MultiQuery, and they can be used alongside queries for jinzhu/gorm while migrating.
+//
+//Polymorphic relationships and relationships of embedded structs are not linked.
+package gormv2
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"sync"
+
+	"github.com/coursehero/hydrate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+//NewQuery will create a query with a given query and sql args, as with hydrate.NewQuery
+func NewQuery(db *gorm.DB, query string, args ...interface{}) hydrate.Query {
+	return hydrate.NewQueryWith(provider{db.NamingStrategy}, executor{db}, query, args...)
+}
+
+//NewTemplateQuery will create a query from a full statement, as with hydrate.NewTemplateQuery
+func NewTemplateQuery(db *gorm.DB, query string, args ...interface{}) hydrate.Query {
+	return NewQuery(db, query, args...).Template()
+}
+
+//NewTreeQuery will create a query to load self-referential hierarchies, as with hydrate.NewTreeQuery
+func NewTreeQuery(db *gorm.DB, cte string, query string, args ...interface{}) hydrate.Query {
+	return NewQuery(db, query, args...).WithRecursive(cte).Tree()
+}
+
+//From will create a builder loading the model given, as with hydrate.From
+func From(db *gorm.DB, model interface{}) hydrate.Builder {
+	return hydrate.FromWith(provider{db.NamingStrategy}, executor{db}, model)
+}
+
+//schemaCaches holds the cache of parsed schemas for each naming strategy, as gorm caches schemas by type only
+var schemaCaches sync.Map
+
+//provider loads the metadata of models from gorm's schema. It is keyed by the naming strategy of the db, which is
+//shared by every session of the db (ie. from WithContext or Begin) so metadata is cached once for all of them. The
+//naming strategy must be comparable, as schema.NamingStrategy is.
+type provider struct {
+	namer schema.Namer
+}
+
+//schema will parse the schema of a model using the cache of the naming strategy
+func (p provider) schema(t reflect.Type) (*schema.Schema, error) {
+	cache, _ := schemaCaches.LoadOrStore(p.namer, &sync.Map{})
+	return schema.Parse(reflect.New(t).Interface(), cache.(*sync.Map), p.namer)
+}
+
+//Model will return the metadata of a model from its schema.Schema
+func (p provider) Model(t reflect.Type) (*hydrate.Model, error) {
+	s, err := p.schema(t)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := hydrate.Model{Type: s.ModelType, Table: s.Table}
+	for _, f := range s.Fields {
+		if f.DBName == "" || !f.Readable {
+			//the field isn't loaded from a column
+			continue
+		}
+
+		field := hydrate.Field{
+			Name:       f.Name,
+			Column:     f.DBName,
+			Type:       f.FieldType,
+			PrimaryKey: f.PrimaryKey,
+		}
+		if f.Serializer != nil {
+			//scan into gorm's serializer value which decodes the column when set
+			field.Scan = f.NewValuePool.Get
+			field.Set = setter(f)
+		} else if sf, ok := t.FieldByName(f.Name); !ok || !equalIndex(sf.Index, f.StructField.Index) {
+			//the field of a named embedded struct can't be set by name, have gorm set it
+			field.Scan = func() interface{} {
+				return reflect.New(reflect.PtrTo(f.FieldType)).Interface()
+			}
+			set := setter(f)
+			field.Set = func(item reflect.Value, scanned interface{}) error {
+				val := reflect.ValueOf(scanned).Elem()
+				if val.IsNil() {
+					return nil
+				}
+				return set(item, val.Elem().Interface())
+			}
+		}
+		ret.Fields = append(ret.Fields, field)
+	}
+
+	//relationships are held in a map, go through fields so they're always in the same order
+	for _, f := range s.Fields {
+		if r, ok := s.Relationships.Relations[f.Name]; ok && r.Polymorphic == nil {
+			ret.Relationships = append(ret.Relationships, relationship(r))
+		}
+	}
+
+	return &ret, nil
+}
+
+//relationship will convert a gorm relationship
+func relationship(r *schema.Relationship) hydrate.Relationship {
+	ret := hydrate.Relationship{
+		Field: r.Name,
+		Kind:  hydrate.RelationshipKind(r.Type),
+	}
+	if r.JoinTable != nil {
+		ret.JoinTable = &hydrate.JoinTable{Table: r.JoinTable.Table}
+	}
+
+	for _, ref := range r.References {
+		switch {
+		case ret.JoinTable != nil && ref.OwnPrimaryKey:
+			ret.AssociationFields = append(ret.AssociationFields, ref.PrimaryKey.Name)
+			ret.JoinTable.SourceColumns = append(ret.JoinTable.SourceColumns, ref.ForeignKey.DBName)
+		case ret.JoinTable != nil:
+			ret.ForeignFields = append(ret.ForeignFields, ref.PrimaryKey.Name)
+			ret.JoinTable.DestinationColumns = append(ret.JoinTable.DestinationColumns, ref.ForeignKey.DBName)
+		case ref.OwnPrimaryKey:
+			//has one or has many, the related model references our key
+			ret.ForeignFields = append(ret.ForeignFields, ref.ForeignKey.Name)
+			ret.AssociationFields = append(ret.AssociationFields, ref.PrimaryKey.Name)
+		default:
+			//belongs to, our model references the key of the related model
+			ret.ForeignFields = append(ret.ForeignFields, ref.PrimaryKey.Name)
+			ret.AssociationFields = append(ret.AssociationFields, ref.ForeignKey.Name)
+		}
+	}
+
+	return ret
+}
+
+//setter will return a func setting a field using gorm
+func setter(f *schema.Field) func(item reflect.Value, scanned interface{}) error {
+	return func(item reflect.Value, scanned interface{}) error {
+		return f.Set(context.Background(), item, scanned)
+	}
+}
+
+//equalIndex will report whether two field indexes are the same
+func equalIndex(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//executor runs statements using a gorm.DB, so args are bound exactly as they would be with db.Raw and the statement
+//is run through gorm's callbacks, ie. to be logged.
+type executor struct {
+	db *gorm.DB
+}
+
+//QueryContext will run a raw query on db using the context provided
+func (e executor) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return e.db.WithContext(ctx).Raw(query, args...).Rows()
+}
@@ -0,0 +1,335 @@
+package gormv2
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coursehero/hydrate"
+	"github.com/coursehero/hydrate/internal/golden"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+var testDB *gorm.DB
+
+func TestMain(m *testing.M) {
+	retCode := setup(m)
+	os.Exit(retCode)
+}
+
+func setup(m *testing.M) int {
+	username := os.Getenv("TEST_DB_USERNAME")
+	if username == "" {
+		username = "root"
+	}
+	password := os.Getenv("TEST_DB_PASSWORD")
+	if password == "" {
+		password = "password"
+	}
+	host := os.Getenv("TEST_DB_HOST")
+	if host == "" {
+		host = "mysql"
+	}
+
+	database := fmt.Sprintf("TEST_HYDRATE_V2_%d", time.Now().UnixNano()/1000)
+
+	drop := createDB(username, password, host, database)
+	defer drop()
+
+	url := fmt.Sprintf("%s:%s@tcp(%s)/%s?parseTime=true&loc=Local", username, password, host, database)
+	var err error
+	testDB, err = gorm.Open(mysql.Open(url), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		panic(err)
+	}
+
+	for _, statement := range []string{
+		`CREATE TABLE authors (
+		author_id int(11) unsigned NOT NULL AUTO_INCREMENT,
+		name varchar(128) NOT NULL,
+		PRIMARY KEY (author_id)
+		)`,
+		`CREATE TABLE textbooks (
+		textbook_id int(10) unsigned NOT NULL AUTO_INCREMENT,
+		author_id int(11) unsigned NULL,
+		name varchar(64) NOT NULL,
+		meta varchar(128) NULL,
+		PRIMARY KEY (textbook_id)
+		)`,
+		`CREATE TABLE sections (
+		section_id int(11) unsigned NOT NULL AUTO_INCREMENT,
+		textbook_id int(10) unsigned NOT NULL,
+		title varchar(128) NOT NULL,
+		PRIMARY KEY (section_id)
+		)`,
+		`CREATE TABLE tags (
+		tag_id int(11) unsigned NOT NULL AUTO_INCREMENT,
+		name varchar(128) NOT NULL,
+		PRIMARY KEY (tag_id)
+		)`,
+		`CREATE TABLE textbook_tags (
+		textbook_id int(10) unsigned NOT NULL,
+		tag_id int(11) unsigned NOT NULL,
+		PRIMARY KEY (textbook_id, tag_id)
+		)`,
+		`CREATE TABLE categories (
+		category_id int(11) unsigned NOT NULL AUTO_INCREMENT,
+		parent_id int(11) unsigned NULL,
+		name varchar(128) NOT NULL,
+		PRIMARY KEY (category_id)
+		)`,
+		`INSERT INTO authors (author_id, name) VALUES (1, "a1")`,
+		`INSERT INTO textbooks (textbook_id, author_id, name, meta)
+		VALUES
+		(1, null, "t1", null),
+		(2, 1, "t2", '{"edition":2}')`,
+		`INSERT INTO sections (section_id, textbook_id, title)
+		VALUES
+		(1, 1, "t1-s1"),
+		(2, 1, "t1-s2"),
+		(3, 2, "t2-s3")`,
+		`INSERT INTO tags (tag_id, name) VALUES (1, "tag1"), (2, "tag2")`,
+		`INSERT INTO textbook_tags (textbook_id, tag_id) VALUES (1, 1), (2, 1), (2, 2)`,
+		`INSERT INTO categories (category_id, parent_id, name)
+		VALUES
+		(1, null, "c1"),
+		(2, 1, "c1-c2"),
+		(3, 2, "c1-c2-c3")`,
+	} {
+		if err := testDB.Exec(statement).Error; err != nil {
+			panic(err)
+		}
+	}
+
+	return m.Run()
+}
+
+func createDB(username, password, host, database string) func() {
+	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s)/", username, password, host))
+	if err != nil {
+		panic(err)
+	}
+
+	for i := 0; ; i++ {
+		if err = db.Ping(); err == nil {
+			break
+		}
+		if i == 20 {
+			panic(err)
+		}
+		time.Sleep(1 * time.Second)
+	}
+
+	_, err = db.Exec(fmt.Sprintf("CREATE DATABASE `%s`", database))
+	if err != nil {
+		panic(fmt.Errorf("failed to create database: %w", err))
+	}
+
+	return func() {
+		_, err = db.Exec(fmt.Sprintf("DROP DATABASE `%s`", database))
+		if err != nil {
+			panic(fmt.Errorf("failed to drop database %w", err))
+		}
+		db.Close()
+	}
+}
+
+func TestQuery(t *testing.T) {
+	tests := []golden.Test{
+		{
+			Name: "should load from single query",
+			Runner: NewQuery(testDB, `FROM textbooks t
+		LEFT JOIN sections s ON s.textbook_id = t.textbook_id
+		LEFT JOIN authors a ON a.author_id = t.author_id
+		LEFT JOIN textbook_tags tt ON tt.textbook_id = t.textbook_id
+		LEFT JOIN tags tg ON tg.tag_id = tt.tag_id
+		WHERE t.textbook_id IN (?)
+		ORDER BY t.textbook_id, s.section_id, tg.tag_id`, []int{1, 2}).
+				AddModel(Textbook{}, "t").
+				AddModel(Section{}, "s").
+				AddModel(Author{}, "a").
+				AddModel(Tag{}, "tg").
+				AddJoinTable(Textbook{}, "Tags", "tt"),
+		},
+		{
+			Name: "should load from multi query",
+			Runner: hydrate.MultiQuery{
+				NewQuery(testDB, `FROM textbooks t
+		LEFT JOIN sections s ON s.textbook_id = t.textbook_id
+		ORDER BY t.textbook_id, s.section_id`).
+					AddModel(Textbook{}, "t").
+					AddModel(Section{}, "s"),
+
+				NewQuery(testDB, `FROM authors ORDER BY author_id`).
+					AddModel(Author{}, ""),
+			},
+		},
+		{
+			Name: "should load from template query",
+			Runner: NewTemplateQuery(testDB, `SELECT DISTINCT {{columns}} FROM textbooks t
+		LEFT JOIN sections s ON s.textbook_id = t.textbook_id
+		ORDER BY t.textbook_id, s.section_id`).
+				AddModel(Textbook{}, "t").
+				AddModel(Section{}, "s"),
+		},
+		{
+			Name: "should error if query has error",
+			Runner: NewQuery(testDB, `FROM textbooks
+		WHERE not_a_column IN (?)`, 1).AddModel(Textbook{}, ""),
+			WantErr: true,
+		},
+	}
+	golden.RunTests(t, tests, hydrate.Optional, func() map[string]interface{} {
+		return map[string]interface{}{
+			"Textbooks": new([]*Textbook),
+			"Authors":   new([]Author),
+		}
+	})
+}
+
+func TestBuilder(t *testing.T) {
+	builder := From(testDB, &Textbook{}).
+		Join("Sections").
+		Join("Author").
+		Join("Tags").
+		Where("t.textbook_id IN (?)", []int{1, 2})
+
+	var textbooks []*Textbook
+	if err := builder.Run(context.Background(), &textbooks); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := builder.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var planned []*Textbook
+	if err := plan.Run(context.Background(), &planned); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, out := range [][]*Textbook{textbooks, planned} {
+		data, err := json.Marshal(map[string]interface{}{"Textbooks": out})
+		if err != nil {
+			t.Fatal(err)
+		}
+		golden.File{Name: "should load from builder"}.Equal(t, data)
+	}
+}
+
+func TestTree(t *testing.T) {
+	var categories []*Category
+	err := NewTreeQuery(testDB, `tree AS (
+		SELECT category_id FROM categories WHERE parent_id IS NULL
+		UNION ALL
+		SELECT c.category_id FROM categories c JOIN tree ON c.parent_id = tree.category_id
+	)`, `FROM tree
+		JOIN categories c ON c.category_id = tree.category_id
+		ORDER BY c.category_id`).
+		AddModel(Category{}, "c").
+		Run(context.Background(), &categories)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//parents reference their children and children their parent, so only encode down the tree
+	var encode func(categories []*Category) []interface{}
+	encode = func(categories []*Category) []interface{} {
+		ret := make([]interface{}, 0, len(categories))
+		for _, c := range categories {
+			var parent string
+			if c.Parent != nil {
+				parent = c.Parent.Name
+			}
+			ret = append(ret, map[string]interface{}{
+				"Name":     c.Name,
+				"Parent":   parent,
+				"Children": encode(c.Children),
+			})
+		}
+		return ret
+	}
+
+	data, err := json.Marshal(encode(categories))
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden.File{Name: "should load tree"}.Equal(t, data)
+}
+
+func TestMetadataCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var providers []provider
+	for i := 0; i < 2; i++ {
+		db := testDB.WithContext(ctx)
+		var textbooks []*Textbook
+		if err := NewQuery(db, `FROM textbooks t ORDER BY t.textbook_id`).AddModel(Textbook{}, "t").Run(ctx, &textbooks); err != nil {
+			t.Fatal(err)
+		}
+		providers = append(providers, provider{db.NamingStrategy})
+	}
+
+	//metadata is cached by provider, so sessions of the same db must build equal providers
+	if providers[0] != providers[1] {
+		t.Errorf("expected sessions to share metadata, got %+v and %+v", providers[0], providers[1])
+	}
+	a, err := providers[0].schema(reflect.TypeOf(Textbook{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := providers[1].schema(reflect.TypeOf(Textbook{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Error("expected sessions to share parsed schemas")
+	}
+}
+
+type Author struct {
+	AuthorID uint `gorm:"primaryKey"`
+	Name     string
+}
+
+type Meta struct {
+	Edition int `json:"edition"`
+}
+
+type Textbook struct {
+	TextbookID uint `gorm:"primaryKey"`
+	AuthorID   *uint
+	Name       string
+	Meta       Meta `gorm:"serializer:json"` //tests serializer fields
+
+	Author   *Author    //tests belongs to
+	Sections []*Section //tests has many
+	Tags     []Tag      `gorm:"many2many:textbook_tags;joinForeignKey:TextbookID;joinReferences:TagID"`
+}
+
+type Section struct {
+	SectionID  uint `gorm:"primaryKey"`
+	TextbookID uint
+	Title      string
+}
+
+type Tag struct {
+	TagID uint `gorm:"primaryKey"`
+	Name  string
+}
+
+type Category struct {
+	CategoryID uint `gorm:"primaryKey"`
+	ParentID   *uint
+	Name       string
+
+	Parent   *Category
+	Children []*Category `gorm:"foreignKey:ParentID"`
+}
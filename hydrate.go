@@ -2,43 +2,189 @@ package hydrate
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"reflect"
 	"strings"
+	"sync"
 
 	"github.com/jinzhu/gorm"
 )
 
+//ColumnsPlaceholder is replaced with the columns selected for all models in the statement of a template query
+const ColumnsPlaceholder = "{{columns}}"
+
 //Query is used to define a query to hydrate data using a single query. Any number of models can be added to be loaded,
 //each model will be added to the select query using the alias provided (or the table name if empty).
 //Each model added will store unique items based on primary key values returned from the query. All relationships for
 //each model will be filled by connecting to other loaded models using the gorm defined relationship.
 type Query struct {
-	db *gorm.DB
+	provider Provider
+	executor Executor
 
 	query string
 	args  []interface{}
-
-	models []modelConfiguration
-	//getModelLoader is used to return modelLoaders from model configuration. This is overwritten for MultiQueries
-	//to allow modelLoaders to be shared across queries
-	getModelLoader func([]modelConfiguration) ([]*modelLoader, []string)
+	//template is set when query is a full statement containing ColumnsPlaceholder
+	template bool
+	//cte is the body of a recursive common table expression used by the query
+	cte string
+	//tree will only output the roots of models referencing their own type
+	tree bool
+	//branches are selected with UNION ALL instead of query when set
+	branches []queryBranch
+	//root is the alias whose items are output for its type, if set
+	root string
+	//batch is set when the query is run for the keys of items loaded by earlier queries of a MultiQuery
+	batch *batchConfiguration
+
+	models     []modelConfiguration
+	joinTables []joinTableConfiguration
+	//getAliasLoader is used to return an aliasLoader for each model configuration. Models of the same type share a
+	//modelLoader. This is overwritten for MultiQueries to allow modelLoaders to be shared across queries
+	getAliasLoader func([]modelConfiguration) ([]*aliasLoader, error)
+	//getJoinTableLoader is used to return joinTableLoaders from join table configuration. Like getAliasLoader this is
+	//overwritten for MultiQueries
+	getJoinTableLoader func([]joinTableConfiguration) ([]*joinTableLoader, []string, error)
 }
 
-//NewQuery will create a query with a given query and sql args
+//NewQuery will create a query with a given query and sql args. Statements are run through db.Raw(...).Rows() when the
+//context given to Run can never be done (ie. context.Background()). gorm v1 callbacks can't take a context, so with a
+//context that can be canceled the statement is built by gorm and run on db.CommonDB() directly, gorm's row query
+//callbacks and LogMode logging are skipped. db.Error and the gorm:query_hint and gorm:query_option settings are used
+//either way.
 func NewQuery(db *gorm.DB, query string, args ...interface{}) Query {
+	return NewQueryWith(gormProvider{}, gormExecutor{db}, query, args...)
+}
+
+//NewQueryWith will create a query loading the metadata of models from provider and running on executor. This allows
+//queries to be built for other libraries than jinzhu/gorm, which NewQuery uses.
+func NewQueryWith(provider Provider, executor Executor, query string, args ...interface{}) Query {
 	return Query{
-		query:          query,
-		args:           args,
-		db:             db,
-		getModelLoader: newModelLoaders,
+		query:    query,
+		args:     args,
+		provider: provider,
+		executor: executor,
+		getAliasLoader: func(models []modelConfiguration) ([]*aliasLoader, error) {
+			return newAliasLoaders(provider, models)
+		},
+		getJoinTableLoader: func(tables []joinTableConfiguration) ([]*joinTableLoader, []string, error) {
+			return newJoinTableLoaders(provider, tables)
+		},
 	}
 }
 
+//NewTemplateQuery will create a query from a full statement. Instead of prefixing the query with SELECT, every
+//ColumnsPlaceholder in the statement is replaced with the columns of all models. This allows any statement that can't
+//start with FROM, such as WITH clauses, SELECT DISTINCT, optimizer hints or a UNION with a placeholder in each SELECT.
+//	SELECT /*+ MAX_EXECUTION_TIME(1000) */ DISTINCT {{columns}} FROM textbooks t ...
+func NewTemplateQuery(db *gorm.DB, query string, args ...interface{}) Query {
+	return NewQuery(db, query, args...).Template()
+}
+
+//NewTreeQuery will create a query to load self-referential hierarchies stored as adjacency lists, such as a parent_id
+//column. cte is the body of a recursive common table expression (ie. `tree AS (... UNION ALL ...)`) which is added
+//to the statement using WITH RECURSIVE, and query is used as with NewQuery to select from it. Args are given in the
+//order they appear in the statement. The query is run as a Tree so only root items are output.
+func NewTreeQuery(db *gorm.DB, cte string, query string, args ...interface{}) Query {
+	return NewQuery(db, query, args...).WithRecursive(cte).Tree()
+}
+
+//Template will set the query to be a full statement, as with NewTemplateQuery
+func (r Query) Template() Query {
+	r.template = true
+
+	return r
+}
+
+//WithRecursive will add a recursive common table expression to the statement, as with NewTreeQuery. It can't be used
+//with Template, the cte must be written in the template instead.
+func (r Query) WithRecursive(cte string) Query {
+	r.cte = cte
+
+	return r
+}
+
+//Tree will set the query to output only the roots of models with relationships to their own type. Relationships
+//are linked between all items loaded, but only items without a loaded parent are output.
+func (r Query) Tree() Query {
+	r.tree = true
+
+	return r
+}
+
+//AsRoot will set the alias defining output order and membership for its type. Instead of every item of the type
+//loaded by the query, outputs of the type only hold the items scanned for alias, in the order they were first
+//scanned, ie. a section loaded both as a root and as a child of a textbook won't output the textbook's other sections.
+//Each streams the items of the root alias. In a MultiQuery the items scanned for the root alias of every query are
+//output, in query order.
+func (r Query) AsRoot(alias string) Query {
+	r.root = alias
+
+	return r
+}
+
 //AddModel will add a model to be loaded during execution. Its fields will be added to the select. If no alias
-//is provided it will use the table name
-func (r Query) AddModel(in interface{}, alias string) Query {
-	r.models = append(r.models, modelConfiguration{in, alias})
+//is provided it will use the table name. The same model can be added with different aliases, for example for a self
+//join, and all items loaded for it will be combined. Options change how items are identified, such as for models
+//without a primary key, and must be the same for every alias of the model.
+func (r Query) AddModel(in interface{}, alias string, options ...ModelOption) Query {
+	m := modelConfiguration{example: in, alias: alias}
+	for _, o := range options {
+		o(&m.options)
+	}
+	r.models = append(r.models, m)
+
+	return r
+}
+
+//ModelOption is an option of AddModel
+type ModelOption func(*modelOptions)
+
+//modelOptions configure how the items of a model are identified
+type modelOptions struct {
+	//naturalKey are the fields identifying items instead of the primary key
+	naturalKey []string
+	//noDedup is set when every row is loaded as its own item
+	noDedup bool
+	//anyNullKeyAbsent is set when an item is absent from a row if any key column is null
+	anyNullKeyAbsent bool
+}
+
+//NaturalKey will identify items by the fields given instead of the primary key, ie. for views or report structs
+//without a primary key. Rows with the same values for every field are loaded as one item, with null fields matching
+//null, and rows where every field is null are skipped. Use AnyNullKeyAbsent to skip rows with a null value for any
+//field instead.
+func NaturalKey(fields ...string) ModelOption {
+	return func(o *modelOptions) {
+		o.naturalKey = fields
+	}
+}
+
+//AnyNullKeyAbsent will skip rows where any column of a composite key is null. By default an item is only absent from a
+//row when every key column is null, so keys with nullable parts identify items, with rows holding null for the same
+//parts and the same values for the rest combined as one item.
+func AnyNullKeyAbsent() ModelOption {
+	return func(o *modelOptions) {
+		o.anyNullKeyAbsent = true
+	}
+}
+
+//NoDedup will load every row as its own item instead of combining rows by key, ie. for audit log rows without a
+//primary key. Rows where every column of the model is null, such as from a failed left join, are skipped. As rows
+//aren't combined, the model should not be joined alongside another relationship to many items which would repeat its
+//rows. Map outputs and ByKey need a key so can't be used for the model.
+func NoDedup() ModelOption {
+	return func(o *modelOptions) {
+		o.noDedup = true
+	}
+}
+
+//AddJoinTable will add the join table of a gorm many2many relationship to be loaded during execution. The model given
+//must be the model defining the relationship and relationship is the name of its many2many field. The join table's
+//keys will be added to the select using the alias provided (or the join table name if empty) and the rows loaded
+//are used to link both sides of the relationship, which must also be loaded by the query or other queries of a MultiQuery.
+func (r Query) AddJoinTable(in interface{}, relationship string, alias string) Query {
+	r.joinTables = append(r.joinTables, joinTableConfiguration{in, relationship, alias})
 
 	return r
 }
@@ -47,52 +193,300 @@ func (r Query) AddModel(in interface{}, alias string) Query {
 //set.
 //If a slice is provided it will fill with all results. If a single item is passed the first item will be returned. However
 //no limiting will be done to the query.
+//If a map is provided it will fill with all results keyed by primary key. The key must hold the primary key field, or be
+//a struct with a field of the same name for each field of a composite primary key.
+//Map keys can't hold pointers, use a type such as sql.NullInt64 for a nullable part of a key.
+//An output of a type no model was loaded for is an error, unless it is wrapped with Optional.
+//The context is passed to the underlying connection so the statement is aborted, and scanning stopped, if it is
+//canceled or its deadline is exceeded. For a query from NewQuery a context that can be done skips gorm's callbacks and
+//logging, see NewQuery.
 func (r Query) Run(ctx context.Context, output ...interface{}) error {
-	loaders, err := r.runQuery()
+	loaders, joins, err := r.run(ctx)
 	if err != nil {
 		return err
 	}
 
-	return fillOutput(loaders, output)
+	return fillOutput(loaders, joins, output)
 }
 
-//runQuery will run the query and return modelLoaders with filled information. Relationships will not be filled
-func (r Query) runQuery() ([]*modelLoader, error) {
-	loaders, aliases := r.getModelLoader(r.models)
-	selects := make([]string, 0, len(loaders))
+//RunResult will run the query and return a Result holding everything loaded, instead of filling outputs
+func (r Query) RunResult(ctx context.Context) (*Result, error) {
+	loaders, joins, err := r.run(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return newResult(loaders, joins)
+}
 
-	for i, l := range loaders {
-		selects = append(selects, l.getSelectStatement(r.db, aliases[i]))
+//run will run the query and return the loaders filled
+func (r Query) run(ctx context.Context) ([]*modelLoader, []*joinTableLoader, error) {
+	if r.batch != nil {
+		return nil, nil, fmt.Errorf("batch queries must be run in a MultiQuery after the items of %T are loaded", r.batch.parent)
 	}
+	return r.runQuery(ctx, processRow)
+}
 
-	rows, err := r.db.Raw(fmt.Sprintf(`%s %s %s`, "SELECT", strings.Join(selects, ","), r.query), r.args...).Rows()
+//Each will run the query and stream each root item to fn as soon as it is fully hydrated, instead of holding all
+//results in memory. fn must be a func(*T) error or func(T) error where T is the type of a model added to the query, and
+//the alias given to AsRoot, or the first alias added for T, is used as the root. The query must be ordered by the
+//primary key of the root so all rows for a root are received together, when the root changes all items loaded for the
+//previous root are finalized, passed to fn and released. As a result items are only shared within a single root, ie. an
+//author of two textbooks will be loaded once for each textbook. Returning an error from fn will stop the query and
+//return the error.
+func (r Query) Each(ctx context.Context, fn interface{}) error {
+	fnVal := reflect.ValueOf(fn)
+	if fnVal.Kind() != reflect.Func || fnVal.Type().NumIn() != 1 || fnVal.Type().NumOut() != 1 ||
+		fnVal.Type().Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+		return fmt.Errorf("type %T must be a func(*T) error", fn)
+	}
+	inType := fnVal.Type().In(0)
+	rootType := inType
+	if rootType.Kind() == reflect.Ptr {
+		rootType = rootType.Elem()
+	}
+	if rootType.Kind() != reflect.Struct {
+		return fmt.Errorf("type %T must be a func(*T) error", fn)
+	}
+	var hasRoot bool
+	for _, m := range r.models {
+		hasRoot = hasRoot || baseType(reflect.TypeOf(m.example)) == rootType
+	}
+	if !hasRoot {
+		return fmt.Errorf("no model of type %s added to query", rootType)
+	}
+	if len(r.branches) > 0 {
+		return fmt.Errorf("union queries can not be streamed, rows of a root are not received together")
+	}
+	if r.batch != nil {
+		return fmt.Errorf("batch queries can not be streamed")
+	}
+
+	var (
+		root    *aliasLoader
+		rootKey key
+		loaders []*modelLoader
+		joins   []*joinTableLoader
+	)
+	//emit will hydrate everything loaded for the current root, pass the root to fn and release all items
+	emit := func() error {
+		if _, err := finalizeOutput(loaders, joins); err != nil {
+			return err
+		}
+
+		i, ok := root.storedKeys[rootKey]
+		if !ok {
+			return fmt.Errorf("root %s of alias %s was not loaded", rootType, root.getAlias(r.executor))
+		}
+		item := root.items[i]
+		for _, l := range loaders {
+			l.reset()
+		}
+		for _, j := range joins {
+			j.reset()
+		}
+
+		in := reflect.ValueOf(item)
+		if inType.Kind() != reflect.Ptr {
+			in = in.Elem()
+		}
+		err, _ := fnVal.Call([]reflect.Value{in})[0].Interface().(error)
+		return err
+	}
+
+	var err error
+	loaders, joins, err = r.runQuery(ctx, func(aliasLoaders []*aliasLoader, rowJoins []*joinTableLoader) error {
+		if root == nil {
+			for _, l := range aliasLoaders {
+				if baseType(l.itemType) == rootType && (r.root == "" || l.root) {
+					root = l
+					break
+				}
+			}
+			if root == nil {
+				return fmt.Errorf("root alias %s is not a %s", r.root, rootType)
+			}
+			loaders = uniqueLoaders(aliasLoaders)
+			joins = rowJoins
+		}
+
+		k, ok, err := root.scanKey()
+		if err != nil {
+			return err
+		}
+		if ok && k != rootKey {
+			if rootKey != nil {
+				//we've moved to a new root so the previous one is complete
+				if err := emit(); err != nil {
+					return err
+				}
+			}
+			rootKey = k
+		}
+
+		return processRow(aliasLoaders, rowJoins)
+	})
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	if rootKey != nil {
+		return emit()
+	}
+	return nil
+}
+
+//processRow is the default handling of a scanned row, it will store the items and links held by the row
+func processRow(aliasLoaders []*aliasLoader, joins []*joinTableLoader) error {
+	for _, l := range aliasLoaders {
+		if err := l.processScan(); err != nil {
+			return err
+		}
+	}
+	for _, j := range joins {
+		if err := j.processScan(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//uniqueLoaders will return the modelLoader of each aliasLoader, in order, without duplicates
+func uniqueLoaders(aliasLoaders []*aliasLoader) []*modelLoader {
+	var loaders []*modelLoader
+	storedLoaders := make(map[*modelLoader]struct{}, len(aliasLoaders))
+	for _, l := range aliasLoaders {
+		if _, ok := storedLoaders[l.modelLoader]; !ok {
+			loaders = append(loaders, l.modelLoader)
+			storedLoaders[l.modelLoader] = struct{}{}
+		}
+	}
+	return loaders
+}
+
+//runQuery will run the query and return modelLoaders and joinTableLoaders with filled information. Relationships will
+//not be filled. process is called with all loaders after each row is scanned.
+func (r Query) runQuery(ctx context.Context, process func([]*aliasLoader, []*joinTableLoader) error) ([]*modelLoader, []*joinTableLoader, error) {
+	if err := r.Validate(); err != nil {
+		return nil, nil, err
+	}
+	aliasLoaders, err := r.getAliasLoader(r.models)
+	if err != nil {
+		return nil, nil, err
+	}
+	joins, joinAliases, err := r.getJoinTableLoader(r.joinTables)
+	if err != nil {
+		return nil, nil, err
+	}
+	selects := make([]string, 0, len(aliasLoaders)+len(joins))
+
+	loaders := uniqueLoaders(aliasLoaders)
+	var hasRoot bool
+	for _, l := range aliasLoaders {
+		selects = append(selects, l.getSelectStatement(r.executor))
+
+		if r.tree {
+			l.tree = true
+		}
+		if r.root != "" && l.getAlias(r.executor) == r.root {
+			hasRoot = true
+			l.root = true
+			l.rooted = true
+		}
+	}
+	if r.root != "" && !hasRoot {
+		return nil, nil, fmt.Errorf("no model added with root alias %s", r.root)
+	}
+	for i, j := range joins {
+		selects = append(selects, j.getSelectStatement(r.executor, joinAliases[i]))
+	}
+
+	statement, args := "", r.args
+	if len(r.branches) > 0 {
+		statement, args = r.unionStatement(aliasLoaders, joins, joinAliases)
+	} else if statement, err = r.statement(strings.Join(selects, ",")); err != nil {
+		return nil, nil, err
+	}
+
+	rows, err := r.executor.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return nil, nil, err
 	}
 	defer rows.Close()
-	scans := make([]interface{}, 0, len(loaders)*3)
-	for _, l := range loaders {
+	scans := make([]interface{}, 0, len(aliasLoaders)*3+1)
+	if len(r.branches) > 0 {
+		//each row is only processed by the loaders of its branch
+		var branch int64
+		scans = append(scans, &branch)
+		process = r.branchProcess(&branch, aliasLoaders, joins, process)
+	}
+	for _, l := range aliasLoaders {
 		//s := l.scanValues
 		//defer closer()
 		scans = append(scans, l.scanValues...)
 	}
+	for _, j := range joins {
+		scans = append(scans, j.scanValues...)
+	}
+	//describeColumns describes each value scanned so scan errors can report where they came from
+	describeColumns := func() []ScanError {
+		columns := make([]ScanError, 0, len(scans))
+		if len(r.branches) > 0 {
+			columns = append(columns, ScanError{Column: BranchColumn})
+		}
+		for _, l := range aliasLoaders {
+			columns = append(columns, l.describeColumns(r.executor)...)
+		}
+		for i, j := range joins {
+			columns = append(columns, j.describeColumns(r.executor, joinAliases[i])...)
+		}
+		return columns
+	}
 	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			//stop scanning as soon as the context is done
+			return nil, nil, err
+		}
 		err := func() error {
 			err := rows.Scan(scans...)
 			if err != nil {
-				return err
+				return newScanError(rows, scans, describeColumns(), err)
 			}
-			for _, l := range loaders {
-				l.processScan()
+			for _, l := range aliasLoaders {
+				l.nextRow()
 			}
-			return nil
+			return process(aliasLoaders, joins)
 		}()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		//the result ended early, ie. the connection was lost, so what has been loaded is incomplete
+		return nil, nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		//the driver closes rows when the context is done, don't treat the partial result as complete
+		return nil, nil, err
+	}
+
+	return loaders, joins, nil
+}
+
+//statement will return the full statement to run selecting the columns given
+func (r Query) statement(columns string) (string, error) {
+	if r.template {
+		if !strings.Contains(r.query, ColumnsPlaceholder) {
+			return "", fmt.Errorf("template query has no %s placeholder", ColumnsPlaceholder)
 		}
+		return strings.Replace(r.query, ColumnsPlaceholder, columns, -1), nil
 	}
 
-	return loaders, nil
+	statement := fmt.Sprintf(`%s %s %s`, "SELECT", columns, r.query)
+	if r.cte != "" {
+		statement = fmt.Sprintf(`%s %s %s`, "WITH RECURSIVE", r.cte, statement)
+	}
+	return statement, nil
 }
 
 //modelConfiguration is used to define how a model is used in a query.
@@ -101,35 +495,52 @@ type modelConfiguration struct {
 	example interface{}
 	//alias is the alias to use within a query
 	alias string
+	//options configure how items are identified
+	options modelOptions
 }
 
-//newModelLoaders is the default implementation for getting modelLoaders from a model definition. This will create new
-//loaders on each call.
-func newModelLoaders(models []modelConfiguration) ([]*modelLoader, []string) {
-	ret := make([]*modelLoader, 0, len(models))
-	aliases := make([]string, 0, len(models))
+//newAliasLoaders is the default implementation for getting aliasLoaders from a model definition. This will create new
+//loaders on each call, with one modelLoader shared by all aliases of the same type.
+func newAliasLoaders(provider Provider, models []modelConfiguration) ([]*aliasLoader, error) {
+	ret := make([]*aliasLoader, 0, len(models))
+	loaderMap := make(map[reflect.Type]*modelLoader, len(models))
 	for _, m := range models {
-		ret = append(ret, newModelLoader(m.example))
-		aliases = append(aliases, m.alias)
+		modelType := baseType(reflect.TypeOf(m.example))
+		l, ok := loaderMap[modelType]
+		if !ok {
+			var err error
+			if l, err = newModelLoader(provider, m.example, m.options); err != nil {
+				return nil, err
+			}
+			loaderMap[modelType] = l
+		}
+		ret = append(ret, l.newAliasLoader(m.alias))
 	}
-	return ret, aliases
+	return ret, nil
 }
 
-//fillOutput will load output results from a slice of modelLoaders
-func fillOutput(loaders []*modelLoader, output []interface{}) error {
-	items := make(map[reflect.Type][]interface{}, len(loaders))
-	for _, l := range loaders {
-		items[baseType(l.itemType)] = l.items
+//fillOutput will load output results from a slice of modelLoaders, using joinTableLoaders to link many2many relationships
+func fillOutput(loaders []*modelLoader, joins []*joinTableLoader, output []interface{}) error {
+	items, err := finalizeOutput(loaders, joins)
+	if err != nil {
+		return err
 	}
 
+	return fillItems(loaders, items, output)
+}
+
+//fillItems will fill outputs with the finalized items of each type
+func fillItems(loaders []*modelLoader, items map[reflect.Type][]interface{}, output []interface{}) error {
+	loaderMap := make(map[reflect.Type]*modelLoader, len(loaders))
 	for _, l := range loaders {
-		err := l.finalize(items)
-		if err != nil {
-			return err
-		}
+		loaderMap[l.itemType] = l
 	}
 
 	for _, o := range output {
+		optional, isOptional := o.(optionalOutput)
+		if isOptional {
+			o = optional.output
+		}
 		val := reflect.ValueOf(o)
 
 		if val.Kind() != reflect.Ptr || val.IsNil() || !val.Elem().CanSet() {
@@ -137,6 +548,27 @@ func fillOutput(loaders []*modelLoader, output []interface{}) error {
 		}
 
 		t := baseType(val.Type())
+		if val.Elem().Kind() == reflect.Map {
+			t = baseType(val.Elem().Type().Elem())
+		}
+		if _, ok := loaderMap[t]; !ok {
+			if isOptional {
+				//the output is left unchanged
+				continue
+			}
+			return fmt.Errorf("no model of type %s was loaded for output %s, loaded types are %s",
+				t, val.Type(), loadedTypes(loaders))
+		}
+
+		if val.Elem().Kind() == reflect.Map {
+			if items, ok := items[t]; ok {
+				if err := fillMap(val.Elem(), loaderMap[t], items); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
 		if items, ok := items[t]; ok {
 			el := val.Elem()
 
@@ -172,47 +604,291 @@ func fillOutput(loaders []*modelLoader, output []interface{}) error {
 	return nil
 }
 
+//optionalOutput is an output that is left unchanged if no model of its type was loaded
+type optionalOutput struct {
+	output interface{}
+}
+
+//Optional will mark an output given to Run as optional. By default an output of a type no model was loaded for is an
+//error, ie. from a typo or a missing AddModel, but an optional output is left unchanged.
+//	err := query.Run(ctx, &textbooks, hydrate.Optional(&solutions))
+func Optional(output interface{}) interface{} {
+	return optionalOutput{output}
+}
+
+//loadedTypes will list the model types of loaders for errors
+func loadedTypes(loaders []*modelLoader) string {
+	if len(loaders) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(loaders))
+	for _, l := range loaders {
+		names = append(names, l.itemType.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+//fillMap will add items to a map output keyed by primary key. The key type must hold the single primary key field,
+//or be a struct with a field of the same name for each primary key field.
+func fillMap(el reflect.Value, l *modelLoader, items []interface{}) error {
+	keyType := el.Type().Key()
+	if len(l.keyFields) == 0 {
+		return fmt.Errorf("map output of %s needs a key to identify items", l.itemType)
+	}
+	if keyType.Kind() == reflect.Ptr {
+		return fmt.Errorf("map key %s must not be a pointer, keys are compared by value", keyType)
+	}
+	composite := keyType.Kind() == reflect.Struct &&
+		(len(l.keyFields) != 1 || !l.keyFields[0].Type.AssignableTo(keyType))
+	if composite && keyType.NumField() != len(l.keyFields) {
+		return fmt.Errorf("map key %s must have a field for each primary key field of %s", keyType, l.itemType)
+	}
+	if !composite && len(l.keyFields) != 1 {
+		return fmt.Errorf("map key %s must be a struct to hold the composite primary key of %s", keyType, l.itemType)
+	}
+
+	if el.IsNil() {
+		el.Set(reflect.MakeMapWithSize(el.Type(), len(items)))
+	}
+	addStruct := el.Type().Elem().Kind() != reflect.Ptr
+	for _, i := range items {
+		itemVal := reflect.ValueOf(i).Elem()
+
+		k := reflect.New(keyType).Elem()
+		for _, f := range l.keyFields {
+			dst := k
+			if composite {
+				if dst = k.FieldByName(f.Name); !dst.IsValid() {
+					return fmt.Errorf("map key %s has no field %s", keyType, f.Name)
+				}
+				if dst.Kind() == reflect.Ptr {
+					return fmt.Errorf("map key %s field %s must not be a pointer, use a type such as sql.NullInt64 to hold null parts", keyType, f.Name)
+				}
+			}
+			v, ok := convertKey(itemVal.FieldByName(f.Name), dst.Type())
+			if !ok {
+				return fmt.Errorf("map key %s can not hold %s.%s", keyType, l.itemType, f.Name)
+			}
+			dst.Set(v)
+		}
+
+		add := reflect.ValueOf(i)
+		if addStruct {
+			//unwrap pointer
+			add = add.Elem()
+		}
+		el.SetMapIndex(k, add)
+	}
+	return nil
+}
+
+//convertKey will convert the value of a key field to the type of a map key. Pointers are followed and numbers can be
+//converted to other numeric types, but values are never converted between numbers and strings. A key type
+//implementing sql.Scanner, ie. sql.NullInt64, scans the value so it can hold a null part.
+func convertKey(val reflect.Value, t reflect.Type) (reflect.Value, bool) {
+	if !val.Type().AssignableTo(t) && reflect.PtrTo(t).Implements(scannerType) {
+		var src interface{}
+		for val.Kind() == reflect.Ptr && !val.IsNil() {
+			val = val.Elem()
+		}
+		if val.Kind() != reflect.Ptr {
+			src = val.Interface()
+		}
+		ret := reflect.New(t)
+		if err := ret.Interface().(sql.Scanner).Scan(src); err != nil {
+			return reflect.Value{}, false
+		}
+		return ret.Elem(), true
+	}
+	for val.Kind() == reflect.Ptr && !val.Type().AssignableTo(t) {
+		if val.IsNil() {
+			return reflect.Value{}, false
+		}
+		val = val.Elem()
+	}
+	if val.Type().AssignableTo(t) {
+		return val, true
+	}
+
+	kind := func(k reflect.Kind) string {
+		switch k {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			return "number"
+		}
+		return k.String()
+	}
+	if kind(val.Kind()) != kind(t.Kind()) || !val.Type().ConvertibleTo(t) {
+		return reflect.Value{}, false
+	}
+	return val.Convert(t), true
+}
+
+//finalizeOutput will finalize all loaders and return the items to output for each type
+func finalizeOutput(loaders []*modelLoader, joins []*joinTableLoader) (map[reflect.Type][]interface{}, error) {
+	items := make(map[reflect.Type][]interface{}, len(loaders))
+	for _, l := range loaders {
+		items[baseType(l.itemType)] = l.items
+	}
+	joinMap := make(map[joinKey]*joinTableLoader, len(joins))
+	for _, j := range joins {
+		joinMap[j.key] = j
+	}
+
+	for _, l := range loaders {
+		err := l.finalize(items, joinMap)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, l := range loaders {
+		if l.rooted {
+			items[baseType(l.itemType)] = l.rootItems()
+		} else if l.tree {
+			//now that all relationships are linked only output the roots
+			items[baseType(l.itemType)] = l.roots()
+		}
+	}
+
+	return items, nil
+}
+
 //MultiQuery will allow you to run multiple Queries and combine all results. Queries are run as normal but all
 //structs are shared across all queries. Meaning relationships can be populated from independent queries, or even
 //a collection of results from the same table can be loaded from multiple queries.
 type MultiQuery []Query
 
-//Run will run all queries and return output combined from all query runs.
+//Run will run all queries and return output combined from all query runs. Queries are run in order and the first
+//error returned, including the context being done, will stop the run and be returned with the index of the failed query.
 func (m MultiQuery) Run(ctx context.Context, output ...interface{}) error {
-	//define loaders we will share across each query run
-	var loaders []*modelLoader
-	loaderMap := make(map[reflect.Type]*modelLoader)
+	loaders, joins, err := m.run(ctx)
+	if err != nil {
+		return err
+	}
+
+	return fillOutput(loaders, joins, output)
+}
+
+//RunResult will run all queries as with Run and return a Result holding everything loaded, instead of filling outputs
+func (m MultiQuery) RunResult(ctx context.Context) (*Result, error) {
+	loaders, joins, err := m.run(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return newResult(loaders, joins)
+}
+
+//run will run all queries in order and return the loaders shared by all queries
+func (m MultiQuery) run(ctx context.Context) ([]*modelLoader, []*joinTableLoader, error) {
+	//loaders are shared across each query run by loading every query into one result
+	res := &Result{}
+	for i, q := range m {
+		if err := res.load(ctx, q, nil); err != nil {
+			return nil, nil, fmt.Errorf("multi query %d: %w", i, err)
+		}
+	}
+
+	return res.loaders, res.joins, nil
+}
 
-	//define a model loader we can use in the individual Queries to pull loaders from our shared map
-	getModelLoader := func(models []modelConfiguration) ([]*modelLoader, []string) {
-		ret := make([]*modelLoader, 0, len(models))
-		aliases := make([]string, 0, len(models))
-		for _, m := range models {
-			modelType := baseType(reflect.TypeOf(m.example))
-			ret = append(ret, loaderMap[modelType])
-			aliases = append(aliases, m.alias)
-		}
-		return ret, aliases
-	}
-
-	for _, q := range m {
-		for _, model := range q.models {
-			modelType := baseType(reflect.TypeOf(model.example))
-			if _, ok := loaderMap[modelType]; !ok {
-				l := newModelLoader(model.example)
-				loaderMap[modelType] = l
-				loaders = append(loaders, l)
+//RunParallel will run queries concurrently using at most n workers, each query running on its own connection from
+//the pool of its executor. Each query loads into its own modelLoaders which are merged into shared loaders in the order
+//queries are defined once all have completed, so output matches Run. If n is less than 1 a worker is used for each query.
+//The first error cancels all other queries. Queries must not use a transaction as it can't run statements concurrently.
+func (m MultiQuery) RunParallel(ctx context.Context, n int, output ...interface{}) error {
+	for i, q := range m {
+		if q.batch != nil {
+			//batches need the items of earlier queries so must be run in order
+			return fmt.Errorf("multi query %d: batch queries can not be run in parallel", i)
+		}
+	}
+	if n < 1 || n > len(m) {
+		n = len(m)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		errOnce sync.Once
+		runErr  error
+	)
+	results := make([][]*modelLoader, len(m))
+	joinResults := make([][]*joinTableLoader, len(m))
+	jobs := make(chan int)
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				loaders, joins, err := m[i].runQuery(ctx, processRow)
+				if err != nil {
+					//record only the first error, any later ones are likely from the cancel below
+					errOnce.Do(func() {
+						runErr = fmt.Errorf("multi query %d: %w", i, err)
+						cancel()
+					})
+					continue
+				}
+				//each worker only writes to its own index so no lock is needed
+				results[i] = loaders
+				joinResults[i] = joins
 			}
+		}()
+	}
+
+dispatch:
+	for i := range m {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break dispatch
 		}
-		q.getModelLoader = getModelLoader
+	}
+	close(jobs)
+	wg.Wait()
 
-		_, err := q.runQuery()
-		if err != nil {
-			return err
+	if runErr != nil {
+		return runErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	//merge results in query order so the items are ordered the same as a serial run
+	var loaders []*modelLoader
+	loaderMap := make(map[reflect.Type]*modelLoader)
+	for i, result := range results {
+		for _, l := range result {
+			modelType := baseType(l.itemType)
+			if shared, ok := loaderMap[modelType]; ok {
+				if err := shared.checkOptions(l.options); err != nil {
+					return fmt.Errorf("multi query %d: %w", i, err)
+				}
+				shared.merge(l)
+				continue
+			}
+			loaderMap[modelType] = l
+			loaders = append(loaders, l)
+		}
+	}
+	var joins []*joinTableLoader
+	joinMap := make(map[joinKey]*joinTableLoader)
+	for _, result := range joinResults {
+		for _, j := range result {
+			if shared, ok := joinMap[j.key]; ok {
+				shared.merge(j)
+				continue
+			}
+			joinMap[j.key] = j
+			joins = append(joins, j)
 		}
 	}
 
-	return fillOutput(loaders, output)
+	return fillOutput(loaders, joins, output)
 }
 
 //baseType will return the fully unwrapped type of slice
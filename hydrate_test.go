@@ -4,11 +4,16 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/coursehero/hydrate/internal/golden"
 	"github.com/jinzhu/gorm"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -103,6 +108,41 @@ func setup(m *testing.M) int {
 	KEY exercise_id (exercise_id)
 	)`)
 
+	db = db.Exec(`CREATE TABLE tags (
+	tag_id int(11) unsigned NOT NULL AUTO_INCREMENT,
+	name varchar(128) NOT NULL,
+	PRIMARY KEY (tag_id)
+	)`)
+
+	db = db.Exec(`CREATE TABLE textbook_tags (
+	tag_id int(11) unsigned NOT NULL,
+	textbook_id int(10) unsigned NOT NULL,
+	PRIMARY KEY (tag_id, textbook_id)
+	)`)
+
+	db = db.Exec(`CREATE TABLE categories (
+	category_id int(11) unsigned NOT NULL AUTO_INCREMENT,
+	parent_id int(11) unsigned NULL,
+	name varchar(128) NOT NULL,
+	PRIMARY KEY (category_id),
+	KEY parent_id (parent_id)
+	)`)
+
+	db = db.Exec(`CREATE TABLE grants (
+	account_id int(11) unsigned NULL,
+	region_id int(11) unsigned NULL,
+	name varchar(128) NOT NULL
+	)`)
+
+	db = db.Exec(`CREATE TABLE reviews (
+	review_id int(11) unsigned NOT NULL AUTO_INCREMENT,
+	textbook_id int(10) unsigned NOT NULL,
+	writer_id int(11) unsigned NOT NULL,
+	reviewer_id int(11) unsigned NOT NULL,
+	text varchar(128) NOT NULL,
+	PRIMARY KEY (review_id)
+	)`)
+
 	db = db.Exec(`
 	INSERT INTO authors (author_id, name, created_at)
 	VALUES
@@ -137,6 +177,44 @@ func setup(m *testing.M) int {
 	(3, 3, "t1-s3-e1", 1, "2019-04-01"),
 	(4, 3, "t1-s3-e2", 2, "2019-04-01")`)
 
+	db = db.Exec(`
+	INSERT INTO tags (tag_id, name)
+	VALUES
+	(1, "tag1"),
+	(2, "tag2"),
+	(3, "tag3")`)
+
+	db = db.Exec(`
+	INSERT INTO textbook_tags (tag_id, textbook_id)
+	VALUES
+	(1, 1),
+	(1, 2),
+	(2, 2)`)
+
+	db = db.Exec(`
+	INSERT INTO categories (category_id, parent_id, name)
+	VALUES
+	(1, null, "c1"),
+	(2, 1, "c1-c2"),
+	(3, 1, "c1-c3"),
+	(4, 2, "c1-c2-c4"),
+	(5, null, "c5")`)
+
+	db = db.Exec(`
+	INSERT INTO reviews (review_id, textbook_id, writer_id, reviewer_id, text)
+	VALUES
+	(1, 1, 1, 2, "r1"),
+	(2, 1, 2, 1, "r2")`)
+
+	db = db.Exec(`
+	INSERT INTO grants (account_id, region_id, name)
+	VALUES
+	(1, null, "g1"),
+	(1, null, "g1-again"),
+	(1, 2, "g1-r2"),
+	(2, null, "g2"),
+	(null, null, "absent")`)
+
 	if db.Error != nil {
 		panic(db.Error)
 	}
@@ -162,159 +240,1329 @@ func createDB(username, password, host, database string) func() {
 				panic(err)
 			}
 		}
-		break
-	}
+		break
+	}
+
+	_, err = db.Exec(fmt.Sprintf("CREATE DATABASE `%s`", database))
+	if err != nil {
+		panic(fmt.Errorf("failed to create database: %w", err))
+	}
+
+	return func() {
+		_, err = db.Exec(fmt.Sprintf("DROP DATABASE `%s`", database))
+		if err != nil {
+			panic(fmt.Errorf("failed to drop database %w", err))
+		}
+		db.Close()
+	}
+}
+
+func TestQuery(t *testing.T) {
+	tests := []golden.Test{
+		{
+			Name: "should load from single query",
+			Runner: NewQuery(testDB, `FROM textbooks t
+		LEFT JOIN isbns i ON i.textbook_id = t.textbook_id
+	   LEFT JOIN sections s on t.textbook_id = s.textbook_id
+		LEFT JOIN exercises e ON e.section_id = s.section_id
+		LEFT JOIN authors a ON a.author_id = t.author_id
+	   WHERE t.textbook_id in (?, ?)
+		ORDER BY t.textbook_id, i.isbn_id, s.section_id, e.exercise_id, a.author_id`, 1, 2).
+				AddModel(Textbook{}, "t").
+				AddModel(Isbn{}, "i").
+				AddModel(Section{}, "s").
+				AddModel(Exercise{}, "e").
+				AddModel(Author{}, "a"),
+		},
+		{
+			Name: "should load from multi query",
+			Runner: MultiQuery{
+				NewQuery(testDB, `FROM textbooks t
+	   LEFT JOIN sections s on t.textbook_id = s.textbook_id
+		LEFT JOIN exercises e ON e.section_id = s.section_id
+	   WHERE t.textbook_id in (?, ?)
+		ORDER BY t.textbook_id, s.section_id, e.exercise_id`, 1, 2).
+					AddModel(Textbook{}, "t").
+					AddModel(Section{}, "s").
+					AddModel(Exercise{}, "e"),
+
+				NewQuery(testDB, `FROM textbooks t
+		JOIN authors a ON a.author_id = t.author_id
+		WHERE t.textbook_id in (?, ?)
+		ORDER BY a.author_id`, 1, 2).
+					AddModel(&Author{}, "a"),
+
+				NewQuery(testDB, `FROM textbooks t
+		JOIN isbns i ON i.textbook_id = t.textbook_id
+		WHERE t.textbook_id in (?, ?)
+		ORDER BY i.isbn_id`, 1, 2).
+					AddModel(&Isbn{}, "i"),
+			},
+		},
+		{
+			Name: "should load from batch multi query",
+			Runner: MultiQuery{
+				NewQuery(testDB, `FROM textbooks t
+	   WHERE t.textbook_id in (?, ?)
+		ORDER BY t.textbook_id`, 1, 2).
+					AddModel(Textbook{}, "t"),
+
+				NewQuery(testDB, `FROM sections s
+		LEFT JOIN exercises e ON e.section_id = s.section_id
+		WHERE s.textbook_id IN ({{keys}})
+		ORDER BY s.section_id, e.exercise_id`).
+					AddModel(Section{}, "s").
+					AddModel(Exercise{}, "e").
+					Batch(Textbook{}, 1, "TextbookID"),
+
+				NewQuery(testDB, `FROM authors a
+		WHERE a.author_id IN ({{keys}})
+		ORDER BY a.author_id`).
+					AddModel(&Author{}, "a").
+					Batch(Textbook{}, 0, "AuthorID"),
+
+				//tests composite keys bound as tuples after other args
+				NewQuery(testDB, `FROM isbns i
+		WHERE i.isbn_id > ? AND (i.textbook_id, i.textbook_id) IN ({{keys}})
+		ORDER BY i.isbn_id`, 0).
+					AddModel(&Isbn{}, "i").
+					Batch(Textbook{}, 1, "TextbookID", "TextbookID"),
+			},
+		},
+		{
+			Name: "should error if batch parent is not loaded",
+			Runner: MultiQuery{
+				NewQuery(testDB, `FROM sections s
+		WHERE s.textbook_id IN ({{keys}})`).
+					AddModel(Section{}, "s").
+					Batch(Textbook{}, 1, "TextbookID"),
+			},
+			WantErr: true,
+		},
+		{
+			Name: "should error if batch query is run in parallel",
+			Runner: parallelMultiQuery{
+				query: MultiQuery{
+					NewQuery(testDB, `FROM textbooks t`).
+						AddModel(Textbook{}, "t"),
+
+					NewQuery(testDB, `FROM sections s
+		WHERE s.textbook_id IN ({{keys}})`).
+						AddModel(Section{}, "s").
+						Batch(Textbook{}, 1, "TextbookID"),
+				},
+			},
+			WantErr: true,
+		},
+		{
+			Name: "should load from parallel multi query",
+			Runner: parallelMultiQuery{
+				workers: 2,
+				query: MultiQuery{
+					NewQuery(testDB, `FROM textbooks t
+	   LEFT JOIN sections s on t.textbook_id = s.textbook_id
+		LEFT JOIN exercises e ON e.section_id = s.section_id
+	   WHERE t.textbook_id in (?, ?)
+		ORDER BY t.textbook_id, s.section_id, e.exercise_id`, 1, 2).
+						AddModel(Textbook{}, "t").
+						AddModel(Section{}, "s").
+						AddModel(Exercise{}, "e"),
+
+					NewQuery(testDB, `FROM textbooks t
+		JOIN authors a ON a.author_id = t.author_id
+		WHERE t.textbook_id in (?, ?)
+		ORDER BY a.author_id`, 1, 2).
+						AddModel(&Author{}, "a"),
+
+					NewQuery(testDB, `FROM textbooks t
+		JOIN isbns i ON i.textbook_id = t.textbook_id
+		WHERE t.textbook_id in (?, ?)
+		ORDER BY i.isbn_id`, 1, 2).
+						AddModel(&Textbook{}, "t").
+						AddModel(&Isbn{}, "i"),
+				},
+			},
+		},
+		{
+			Name: "should error if one parallel multi query has error",
+			Runner: parallelMultiQuery{
+				query: MultiQuery{
+					NewQuery(testDB, `FROM textbooks tb
+	   WHERE tb.textbook_id in (?)`, 1).
+						AddModel(&Textbook{}, "tb"),
+					NewQuery(testDB, `FROM textbooks
+	   WHERE not_a_column in (?)`, 1).AddModel(&Textbook{}, ""),
+				},
+			},
+			WantErr: true,
+		},
+		{
+			Name: "should use independent aliases in multi query",
+			Runner: MultiQuery{
+				NewQuery(testDB, `FROM textbooks tb
+	   WHERE tb.textbook_id in (?)`, 1).
+					AddModel(&Textbook{}, "tb"),
+
+				NewQuery(testDB, `FROM textbooks t
+	   WHERE t.textbook_id in (?)`, 2).
+					AddModel(&Textbook{}, "t"),
+			},
+		},
+		{
+			Name: "should load from template query",
+			Runner: NewTemplateQuery(testDB, `SELECT DISTINCT {{columns}} FROM textbooks t
+		LEFT JOIN isbns i ON i.textbook_id = t.textbook_id
+	   LEFT JOIN sections s on t.textbook_id = s.textbook_id
+		LEFT JOIN exercises e ON e.section_id = s.section_id
+		LEFT JOIN authors a ON a.author_id = t.author_id
+	   WHERE t.textbook_id in (?, ?)
+		ORDER BY t.textbook_id, i.isbn_id, s.section_id, e.exercise_id, a.author_id`, 1, 2).
+				AddModel(Textbook{}, "t").
+				AddModel(Isbn{}, "i").
+				AddModel(Section{}, "s").
+				AddModel(Exercise{}, "e").
+				AddModel(Author{}, "a"),
+		},
+		{
+			Name: "should load from template query with cte and union",
+			Runner: NewTemplateQuery(testDB, `WITH authored AS (SELECT textbook_id FROM textbooks WHERE author_id IS NOT NULL)
+		SELECT {{columns}} FROM textbooks t
+		JOIN authored ON authored.textbook_id = t.textbook_id
+		LEFT JOIN authors a ON a.author_id = t.author_id
+		WHERE t.textbook_id = ?
+		UNION ALL
+		SELECT {{columns}} FROM textbooks t
+		LEFT JOIN authors a ON a.author_id = t.author_id
+		WHERE t.textbook_id = ?`, 2, 1).
+				AddModel(Textbook{}, "t").
+				AddModel(Author{}, "a"),
+		},
+		{
+			Name: "should error if template query has no placeholder",
+			Runner: NewTemplateQuery(testDB, `SELECT * FROM textbooks t
+	   WHERE t.textbook_id in (?)`, 1).AddModel(&Textbook{}, "t"),
+			WantErr: true,
+		},
+		{
+			Name: "should use table name as alias if not provided",
+			Runner: NewQuery(testDB, `FROM textbooks
+	   WHERE textbook_id in (?)`, 1).AddModel(&Textbook{}, ""),
+		},
+		{
+	   		Name: "should error if query has error",
+			Runner: NewQuery(testDB, `FROM textbooks
+	   WHERE not_a_column in (?)`, 1).AddModel(&Textbook{}, ""),
+	   		WantErr: true,
+		},
+		{
+			Name: "should error if one multi query has error",
+			Runner: MultiQuery{
+				NewQuery(testDB, `FROM textbooks tb
+	   WHERE tb.textbook_id in (?)`, 1).
+					AddModel(&Textbook{}, "tb"),
+				NewQuery(testDB, `FROM textbooks
+	   WHERE not_a_column in (?)`, 1).AddModel(&Textbook{}, ""),
+			},
+			WantErr: true,
+		},
+		{
+			Name: "should error if struct can not scan into result",
+			Runner: NewQuery(testDB, `FROM textbooks t
+	   WHERE textbook_id in (?)`, 1).AddModel(BadTextbook{}, "t"),
+	   WantErr: true,
+		},
+	}
+	golden.RunTests(t, tests, Optional, func() map[string]interface{} {
+		return map[string]interface{}{
+			"Textbooks": new([]*Textbook), //test slice array output
+			"Authors":   new([]Author),    //test slice struct output
+			"Isbn":      new(*Isbn),       //test ptr output
+			"Exercise":  new(Exercise),    //test struct output
+		}
+	})
+
+	t.Run("should error if output can not be assigned", func(t *testing.T) {
+		var tb Textbook
+		err := NewQuery(testDB, `FROM textbooks t
+	  WHERE textbook_id in (?)`, 1).AddModel(&Textbook{}, "t").Run(context.Background(), tb)
+
+		if err == nil {
+			t.Error(fmt.Errorf("expected error result from unassignable output variable"))
+		}
+	})
+
+	t.Run("should error if output type was not loaded", func(t *testing.T) {
+		query := NewQuery(testDB, `FROM textbooks t
+	  WHERE textbook_id in (?)`, 1).AddModel(&Textbook{}, "t")
+
+		err := query.Run(context.Background(), &[]*Textbook{}, &[]Tag{})
+		if err == nil || !strings.Contains(err.Error(), "loaded types are hydrate.Textbook") {
+			t.Errorf("expected error listing loaded types, got %v", err)
+		}
+
+		tags := []Tag{{TagID: 1}}
+		if err := query.Run(context.Background(), &[]*Textbook{}, Optional(&tags)); err != nil {
+			t.Error(err)
+		}
+		if len(tags) != 1 {
+			t.Error("expected optional output to be unchanged")
+		}
+	})
+
+	t.Run("should return scan error describing the field", func(t *testing.T) {
+		err := NewQuery(testDB, `FROM textbooks t
+	  WHERE textbook_id in (?)`, 1).AddModel(BadTextbook{}, "t").Run(context.Background(), &[]BadTextbook{})
+
+		var scanErr *ScanError
+		if !errors.As(err, &scanErr) {
+			t.Errorf("expected scan error, got %v", err)
+			return
+		}
+		expected := ScanError{Alias: "t", Model: "BadTextbook", Field: "Name", Column: "name", Err: scanErr.Err}
+		if *scanErr != expected {
+			t.Errorf("expected %+v, got %+v", expected, *scanErr)
+		}
+	})
+
+	t.Run("should return context error if context is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		var textbooks []*Textbook
+		err := NewQuery(testDB, `FROM textbooks t
+	  WHERE textbook_id in (?)`, 1).AddModel(&Textbook{}, "t").Run(ctx, &textbooks)
+
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context canceled error, got %v", err)
+		}
+		if len(textbooks) != 0 {
+			t.Errorf("expected no textbooks to be loaded, got %d", len(textbooks))
+		}
+	})
+
+	t.Run("should use gorm settings of the db", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		for _, c := range []context.Context{context.Background(), ctx} {
+			var textbooks []*Textbook
+			err := NewQuery(testDB.Set("gorm:query_option", "LIMIT 1"), `FROM textbooks t
+	  ORDER BY t.textbook_id`).AddModel(&Textbook{}, "t").Run(c, &textbooks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(textbooks) != 1 {
+				t.Errorf("expected query option to limit textbooks, got %d", len(textbooks))
+			}
+
+			db := testDB.New()
+			db.AddError(fmt.Errorf("db error"))
+			err = NewQuery(db, `FROM textbooks t`).AddModel(&Textbook{}, "t").Run(c, &textbooks)
+			if err == nil || err.Error() != "db error" {
+				t.Errorf("expected error of the db, got %v", err)
+			}
+		}
+	})
+
+	t.Run("should return context error with query index in multi query", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+		defer cancel()
+
+		err := MultiQuery{
+			NewQuery(testDB, `FROM textbooks t
+	  WHERE textbook_id in (?)`, 1).AddModel(&Textbook{}, "t"),
+		}.Run(ctx, &[]*Textbook{})
+
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected deadline exceeded error, got %v", err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "multi query 0") {
+			t.Errorf("expected error to include the failed query, got %v", err)
+		}
+	})
+}
+
+func TestJoinTable(t *testing.T) {
+	tests := []golden.Test{
+		{
+			Name: "should load many2many from single query",
+			Runner: NewQuery(testDB, `FROM tags tg
+		LEFT JOIN textbook_tags tt ON tt.tag_id = tg.tag_id
+		LEFT JOIN textbooks t ON t.textbook_id = tt.textbook_id
+		ORDER BY tg.tag_id, t.textbook_id`).
+				AddModel(Tag{}, "tg").
+				AddModel(Textbook{}, "t").
+				AddJoinTable(Tag{}, "Textbooks", "tt"),
+		},
+		{
+			Name: "should load many2many from multi query",
+			Runner: MultiQuery{
+				NewQuery(testDB, `FROM tags tg
+		ORDER BY tg.tag_id`).
+					AddModel(Tag{}, "tg"),
+
+				NewQuery(testDB, `FROM textbook_tags
+		JOIN textbooks t ON t.textbook_id = textbook_tags.textbook_id
+		ORDER BY t.textbook_id`).
+					AddModel(Textbook{}, "t").
+					AddJoinTable(&Tag{}, "Textbooks", ""),
+			},
+		},
+		{
+			Name: "should error if join table relationship is not many2many",
+			Runner: NewQuery(testDB, `FROM tags tg`).
+				AddModel(Tag{}, "tg").
+				AddJoinTable(Tag{}, "Name", "tt"),
+			WantErr: true,
+		},
+	}
+	golden.RunTests(t, tests, nil, func() map[string]interface{} {
+		return map[string]interface{}{
+			"Tags": new([]Tag),
+		}
+	})
+}
+
+func TestSQLQuery(t *testing.T) {
+	tests := []golden.Test{
+		{
+			Name: "should load from sql query",
+			Runner: NewSQLQuery(testDB.DB(), `FROM textbooks t
+		LEFT JOIN sections s ON s.textbook_id = t.textbook_id
+		LEFT JOIN authors a ON a.author_id = t.author_id
+		LEFT JOIN textbook_tags tt ON tt.textbook_id = t.textbook_id
+		LEFT JOIN tags tg ON tg.tag_id = tt.tag_id
+		WHERE t.textbook_id IN (?, ?)
+		ORDER BY t.textbook_id, s.section_id, tg.tag_id`, 1, 2).
+				AddModel(SQLTextbook{}, "t").
+				AddModel(SQLSection{}, "s").
+				AddModel(SQLAuthor{}, "a").
+				AddModel(SQLTag{}, "tg").
+				AddJoinTable(SQLTextbook{}, "Tags", "tt"),
+		},
+		{
+			Name: "should load from sql multi query",
+			Runner: MultiQuery{
+				NewSQLQuery(testDB.DB(), `FROM textbooks ORDER BY textbook_id`).
+					AddModel(SQLTextbook{}, ""),
+				NewSQLQuery(testDB.DB(), `FROM sections ORDER BY section_id`).
+					AddModel(SQLSection{}, ""),
+			},
+		},
+		{
+			Name: "should error if sql tag is invalid",
+			Runner: NewSQLQuery(testDB.DB(), `FROM textbooks t`).
+				AddModel(BadSQLTextbook{}, "t"),
+			WantErr: true,
+		},
+	}
+	golden.RunTests(t, tests, nil, func() map[string]interface{} {
+		return map[string]interface{}{
+			"Textbooks": new([]*SQLTextbook),
+		}
+	})
+}
+
+func TestBuilder(t *testing.T) {
+	tests := []golden.Test{
+		{
+			Name: "should load from builder",
+			Runner: From(testDB, &Textbook{}).
+				Join("Isbns").
+				Join("Sections.Exercises").
+				Join("AuthorPtr").
+				Where("t.textbook_id IN (?)", []int{1, 2}),
+		},
+		{
+			Name: "should load many2many from builder",
+			Runner: From(testDB, Tag{}).
+				Join("Textbooks.Sections").
+				Where("t.tag_id = ?", 1).
+				Where("t_textbooks.textbook_id IS NOT NULL"),
+		},
+		{
+			Name: "should load from builder plan",
+			Runner: planned(From(testDB, &Textbook{}).
+				Join("Isbns").
+				Join("Sections.Exercises").
+				Join("AuthorPtr").
+				Where("t.textbook_id IN (?)", []int{1, 2})),
+		},
+		{
+			Name: "should load many2many from builder plan",
+			Runner: planned(From(testDB, Tag{}).
+				Join("Textbooks.Sections").
+				Where("t.tag_id = ?", 1)),
+		},
+		{
+			Name: "should load from builder union",
+			Runner: unioned(From(testDB, &Textbook{}).
+				Join("Isbns").
+				Join("Sections.Exercises").
+				Join("AuthorPtr").
+				Where("t.textbook_id IN (?)", []int{1, 2})),
+		},
+		{
+			Name: "should load many2many from builder union",
+			Runner: unioned(From(testDB, Tag{}).
+				Join("Textbooks.Sections").
+				Where("t.tag_id = ?", 1)),
+		},
+		{
+			Name:    "should error if builder relationship does not exist",
+			Runner:  From(testDB, Textbook{}).Join("Sections.Pages"),
+			WantErr: true,
+		},
+	}
+	golden.RunTests(t, tests, Optional, func() map[string]interface{} {
+		return map[string]interface{}{
+			"Textbooks": new([]*Textbook),
+			"Tags":      new([]Tag),
+		}
+	})
+}
+
+//planned will run the MultiQuery planned by b
+func planned(b Builder) golden.RunnerFunc {
+	return func(ctx context.Context, output ...interface{}) error {
+		q, err := b.Plan()
+		if err != nil {
+			return err
+		}
+		return q.Run(ctx, output...)
+	}
+}
+
+//unioned will run the union query of b
+func unioned(b Builder) golden.RunnerFunc {
+	return func(ctx context.Context, output ...interface{}) error {
+		q, err := b.Union()
+		if err != nil {
+			return err
+		}
+		return q.Run(ctx, output...)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	tests := []golden.Test{
+		{
+			Name: "should load self join into one identity map",
+			Runner: NewQuery(testDB, `FROM categories c
+		LEFT JOIN categories ch ON ch.parent_id = c.category_id
+		WHERE c.category_id IN (?)
+		ORDER BY c.category_id, ch.category_id`, []int{1, 2}).
+				AddModel(Category{}, "c").
+				AddModel(Category{}, "ch"),
+		},
+		{
+			Name: "should output only items of the root alias",
+			Runner: NewQuery(testDB, `FROM categories c
+		LEFT JOIN categories ch ON ch.parent_id = c.category_id
+		WHERE c.category_id IN (?)
+		ORDER BY c.category_id DESC, ch.category_id`, []int{1, 2}).
+				AddModel(Category{}, "c").
+				AddModel(Category{}, "ch").
+				AsRoot("c"),
+		},
+		{
+			Name: "should load multiple roles of the same model",
+			Runner: NewQuery(testDB, `FROM reviews r
+		JOIN authors w ON w.author_id = r.writer_id
+		JOIN authors rv ON rv.author_id = r.reviewer_id
+		ORDER BY r.review_id`).
+				AddModel(Review{}, "r").
+				AddModel(Author{}, "w").
+				AddModel(Author{}, "rv"),
+		},
+		{
+			Name: "should load multiple roles of the same model in multi query",
+			Runner: MultiQuery{
+				NewQuery(testDB, `FROM reviews r
+		JOIN authors w ON w.author_id = r.writer_id
+		WHERE r.review_id = ?`, 1).
+					AddModel(Review{}, "r").
+					AddModel(Author{}, "w"),
+				NewQuery(testDB, `FROM reviews r
+		JOIN authors w ON w.author_id = r.writer_id
+		JOIN authors rv ON rv.author_id = r.reviewer_id
+		WHERE r.review_id = ?`, 2).
+					AddModel(Review{}, "r").
+					AddModel(Author{}, "w").
+					AddModel(Author{}, "rv"),
+			},
+		},
+	}
+	golden.RunTests(t, tests, Optional, func() map[string]interface{} {
+		return map[string]interface{}{
+			"Categories": new([]*Category),
+			"Reviews":    new([]Review),
+			"Authors":    new([]Author),
+		}
+	})
+}
+
+func TestTree(t *testing.T) {
+	const cte = `tree AS (
+		SELECT category_id FROM categories WHERE category_id IN (?)
+		UNION ALL
+		SELECT c.category_id FROM categories c JOIN tree ON c.parent_id = tree.category_id
+	)`
+	tests := []golden.Test{
+		{
+			Name: "should load tree from recursive query",
+			Runner: NewTreeQuery(testDB, cte, `FROM tree
+		JOIN categories c ON c.category_id = tree.category_id
+		ORDER BY c.category_id`, []int{1, 5}).
+				AddModel(Category{}, "c"),
+		},
+		{
+			Name: "should load subtree from recursive query",
+			Runner: NewTreeQuery(testDB, cte, `FROM tree
+		JOIN categories c ON c.category_id = tree.category_id
+		ORDER BY c.category_id`, 2).
+				AddModel(Category{}, "c"),
+		},
+		{
+			Name: "should load roots from self join tree",
+			Runner: NewQuery(testDB, `FROM categories c
+		LEFT JOIN categories ch ON ch.parent_id = c.category_id
+		WHERE c.category_id IN (?)
+		ORDER BY c.category_id, ch.category_id`, []int{1, 2}).
+				AddModel(Category{}, "c").
+				AddModel(Category{}, "ch").
+				Tree(),
+		},
+	}
+	golden.RunTests(t, tests, nil, func() map[string]interface{} {
+		return map[string]interface{}{
+			"Categories": new([]*Category),
+		}
+	})
+}
+
+func TestEach(t *testing.T) {
+	query := NewQuery(testDB, `FROM textbooks t
+		LEFT JOIN isbns i ON i.textbook_id = t.textbook_id
+		LEFT JOIN sections s on t.textbook_id = s.textbook_id
+		LEFT JOIN exercises e ON e.section_id = s.section_id
+		LEFT JOIN authors a ON a.author_id = t.author_id
+		WHERE t.textbook_id in (?, ?)
+		ORDER BY t.textbook_id, i.isbn_id, s.section_id, e.exercise_id`, 1, 2).
+		AddModel(Textbook{}, "t").
+		AddModel(Isbn{}, "i").
+		AddModel(Section{}, "s").
+		AddModel(Exercise{}, "e").
+		AddModel(Author{}, "a")
+
+	t.Run("should stream each root", func(t *testing.T) {
+		var textbooks []*Textbook
+		err := query.Each(context.Background(), func(t *Textbook) error {
+			textbooks = append(textbooks, t)
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		g := golden.File{Name: "should stream each root"}
+		data, err := json.Marshal(map[string]interface{}{
+			"Textbooks": textbooks,
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		g.Equal(t, data)
+	})
+
+	t.Run("should stop when func returns error", func(t *testing.T) {
+		stop := errors.New("stop")
+		var calls int
+		err := query.Each(context.Background(), func(t Textbook) error {
+			calls++
+			return stop
+		})
+		if err != stop {
+			t.Errorf("expected error from func, got %v", err)
+		}
+		if calls != 1 {
+			t.Errorf("expected a single call, got %d", calls)
+		}
+	})
+
+	t.Run("should error if func is invalid", func(t *testing.T) {
+		err := query.Each(context.Background(), func(t *Textbook) {})
+		if err == nil {
+			t.Error("expected error from invalid func")
+		}
+	})
+
+	t.Run("should stream items of the root alias", func(t *testing.T) {
+		var ids []uint
+		err := NewQuery(testDB, `FROM categories c
+		JOIN categories p ON p.category_id = c.parent_id
+		ORDER BY p.category_id, c.category_id`).
+			AddModel(Category{}, "c").
+			AddModel(Category{}, "p").
+			AsRoot("p").
+			Each(context.Background(), func(c *Category) error {
+				ids = append(ids, c.CategoryID)
+				return nil
+			})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if fmt.Sprint(ids) != "[1 2]" {
+			t.Errorf("expected parent categories [1 2], got %v", ids)
+		}
+	})
+
+	t.Run("should error if root alias was not added", func(t *testing.T) {
+		err := query.AsRoot("x").Run(context.Background(), &[]*Textbook{})
+		if err == nil {
+			t.Error("expected error from missing root alias")
+		}
+	})
+
+	t.Run("should error if root model was not added", func(t *testing.T) {
+		err := query.Each(context.Background(), func(t *Tag) error { return nil })
+		if err == nil {
+			t.Error("expected error from missing root model")
+		}
+	})
+}
+
+func TestMapOutput(t *testing.T) {
+	t.Run("should key map outputs by primary key", func(t *testing.T) {
+		var byID map[uint]*Textbook
+		byInt := map[int64]Textbook{}
+		byStruct := map[struct{ TextbookID uint }]*Textbook{}
+		var sections map[uint]*Section
+		err := NewQuery(testDB, `FROM textbooks t
+		LEFT JOIN sections s ON s.textbook_id = t.textbook_id
+		WHERE t.textbook_id IN (?)
+		ORDER BY t.textbook_id, s.section_id`, []int{1, 2}).
+			AddModel(Textbook{}, "t").
+			AddModel(Section{}, "s").
+			Run(context.Background(), &byID, &byInt, &byStruct, &sections)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(byID) != 2 || len(byInt) != 2 || len(byStruct) != 2 {
+			t.Fatalf("expected 2 textbooks in each map, got %d, %d and %d", len(byID), len(byInt), len(byStruct))
+		}
+		for id, textbook := range byID {
+			if textbook.TextbookID != id || byInt[int64(id)].TextbookID != id || byStruct[struct{ TextbookID uint }{id}] != textbook {
+				t.Errorf("expected textbook %d under the same key of each map", id)
+			}
+		}
+		for id, section := range sections {
+			if *section.SectionID != id {
+				t.Errorf("expected section %d keyed by its pointer key, got %d", *section.SectionID, id)
+			}
+		}
+	})
+
+	t.Run("should key map outputs by composite primary key", func(t *testing.T) {
+		type textbookTagKey struct {
+			TagID      int
+			TextbookID int
+		}
+		var textbookTags map[textbookTagKey]TextbookTag
+		err := NewQuery(testDB, `FROM textbook_tags tt`).
+			AddModel(TextbookTag{}, "tt").
+			Run(context.Background(), &textbookTags)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(textbookTags) == 0 {
+			t.Fatal("expected textbook tags to be loaded")
+		}
+		for k, tt := range textbookTags {
+			if k.TagID != int(tt.TagID) || k.TextbookID != int(tt.TextbookID) {
+				t.Errorf("expected %+v to be keyed by its primary key, got %+v", tt, k)
+			}
+		}
+	})
+
+	t.Run("should error if map key can not hold primary key", func(t *testing.T) {
+		for _, output := range []interface{}{
+			&map[string]*Textbook{},
+			&map[struct{ ID uint }]*Textbook{},
+			&map[uint]*TextbookTag{},
+			&map[*uint]*Textbook{},
+			&map[struct {
+				TextbookID uint
+				TagID      *uint
+			}]*TextbookTag{},
+		} {
+			err := MultiQuery{
+				NewQuery(testDB, `FROM textbooks t WHERE t.textbook_id = ?`, 1).AddModel(Textbook{}, "t"),
+				NewQuery(testDB, `FROM textbook_tags tt`).AddModel(TextbookTag{}, "tt"),
+			}.Run(context.Background(), output)
+			if err == nil {
+				t.Errorf("expected error result for %T", output)
+			}
+		}
+	})
+}
+
+func TestResult(t *testing.T) {
+	textbooks := NewQuery(testDB, `FROM textbooks t
+	   LEFT JOIN sections s on t.textbook_id = s.textbook_id
+		LEFT JOIN exercises e ON e.section_id = s.section_id
+	   WHERE t.textbook_id in (?, ?)
+		ORDER BY t.textbook_id, s.section_id, e.exercise_id`, 1, 2).
+		AddModel(Textbook{}, "t").
+		AddModel(Section{}, "s").
+		AddModel(Exercise{}, "e")
+
+	t.Run("should read items from result", func(t *testing.T) {
+		res, err := textbooks.RunResult(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n := Count[Textbook](res); n != 2 || len(All[Textbook](res)) != n {
+			t.Errorf("expected 2 textbooks, got %d", n)
+		}
+		if n := Count[Author](res); n != 0 {
+			t.Errorf("expected no authors, got %d", n)
+		}
+
+		textbook, ok, err := ByKey[Textbook](res, 2)
+		if err != nil || !ok {
+			t.Fatalf("expected textbook 2, got %v", err)
+		}
+		if textbook != All[Textbook](res)[1] {
+			t.Error("expected the same item from ByKey and All")
+		}
+		if _, ok, _ := ByKey[Textbook](res, uint64(3)); ok {
+			t.Error("expected no textbook 3")
+		}
+		if _, _, err := ByKey[Textbook](res, 1, 2); err == nil {
+			t.Error("expected error for too many key values")
+		}
+	})
+
+	t.Run("should load into existing result", func(t *testing.T) {
+		res, err := NewQuery(testDB, `FROM textbooks t
+	   WHERE t.textbook_id in (?, ?)
+		ORDER BY t.textbook_id`, 1, 2).
+			AddModel(Textbook{}, "t").
+			RunResult(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		textbooks := All[Textbook](res)
+
+		err = MultiQuery{
+			NewQuery(testDB, `FROM sections s
+		WHERE s.textbook_id IN ({{keys}})
+		ORDER BY s.section_id`).
+				AddModel(Section{}, "s").
+				Batch(Textbook{}, 0, "TextbookID"),
+		}.RunInto(context.Background(), res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = NewQuery(testDB, `FROM textbooks t
+		JOIN authors a ON a.author_id = t.author_id
+		WHERE t.textbook_id in (?, ?)`, 1, 2).
+			AddModel(Textbook{}, "t").
+			AddModel(Author{}, "a").
+			RunInto(context.Background(), res)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n := Count[Textbook](res); n != 2 {
+			t.Errorf("expected textbooks to be merged, got %d", n)
+		}
+		var sections, authors int
+		for _, textbook := range textbooks {
+			sections += len(textbook.Sections)
+			if textbook.AuthorPtr != nil {
+				authors++
+			}
+		}
+		if sections != Count[Section](res) || sections == 0 {
+			t.Errorf("expected all %d sections to be linked in place, got %d", Count[Section](res), sections)
+		}
+		if authors == 0 {
+			t.Error("expected authors to be linked in place")
+		}
+	})
+
+	t.Run("should leave result unchanged if load fails", func(t *testing.T) {
+		res, err := NewQuery(testDB, `FROM textbooks t
+	   WHERE t.textbook_id in (?, ?)
+		ORDER BY t.textbook_id`, 1, 2).
+			AddModel(Textbook{}, "t").
+			RunResult(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = MultiQuery{
+			NewQuery(testDB, `FROM sections s
+		WHERE s.textbook_id IN ({{keys}})
+		ORDER BY s.section_id`).
+				AddModel(Section{}, "s").
+				Batch(Textbook{}, 0, "TextbookID"),
+			NewQuery(testDB, `FROM textbooks t
+		JOIN authors a ON a.author_id = t.author_id
+		WHERE not_a_column IN (?)`, 1).
+				AddModel(Textbook{}, "t").
+				AddModel(Author{}, "a"),
+		}.RunInto(context.Background(), res)
+		if err == nil {
+			t.Fatal("expected error result")
+		}
+
+		if res.loader(reflect.TypeOf(Section{})) != nil || res.loader(reflect.TypeOf(Author{})) != nil {
+			t.Error("expected no loaders to be added by the failed load")
+		}
+		for _, textbook := range All[Textbook](res) {
+			if len(textbook.Sections) != 0 {
+				t.Errorf("expected no sections to be linked, got %d", len(textbook.Sections))
+			}
+		}
+	})
+
+	t.Run("should load typed items", func(t *testing.T) {
+		loaded, err := Load[Textbook](context.Background(), textbooks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(loaded) != 2 {
+			t.Errorf("expected 2 textbooks, got %d", len(loaded))
+		}
+
+		textbook, err := LoadOne[Textbook](context.Background(), From(testDB, Textbook{}).Where("t.textbook_id = ?", 2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if textbook == nil || textbook.TextbookID != 2 {
+			t.Errorf("expected textbook 2, got %+v", textbook)
+		}
+
+		if _, err := Load[Author](context.Background(), textbooks); err == nil {
+			t.Error("expected error for type not added to query")
+		}
+	})
+
+	t.Run("should merge results", func(t *testing.T) {
+		res, err := textbooks.RunResult(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, q := range []Query{
+			NewQuery(testDB, `FROM textbooks t
+		JOIN authors a ON a.author_id = t.author_id
+		WHERE t.textbook_id in (?, ?)
+		ORDER BY a.author_id`, 1, 2).
+				AddModel(&Author{}, "a"),
+
+			NewQuery(testDB, `FROM textbooks t
+		JOIN isbns i ON i.textbook_id = t.textbook_id
+		WHERE t.textbook_id in (?, ?)
+		ORDER BY i.isbn_id`, 1, 2).
+				AddModel(&Isbn{}, "i"),
+		} {
+			other, err := q.RunResult(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := res.Merge(other); err != nil {
+				t.Fatal(err)
+			}
+		}
+		//finalizing again must not link relationships twice
+		if err := res.Finalize(); err != nil {
+			t.Fatal(err)
+		}
 
-	_, err = db.Exec(fmt.Sprintf("CREATE DATABASE `%s`", database))
-	if err != nil {
-		panic(fmt.Errorf("failed to create database: %w", err))
-	}
+		var textbooks []*Textbook
+		var authors []Author
+		var isbn *Isbn
+		var exercise Exercise
+		if err := res.Fill(&textbooks, &authors, &isbn, &exercise); err != nil {
+			t.Fatal(err)
+		}
 
-	return func() {
-		_, err = db.Exec(fmt.Sprintf("DROP DATABASE `%s`", database))
+		g := golden.File{Name: "should load from multi query"}
+		data, err := json.Marshal(map[string]interface{}{
+			"Textbooks": textbooks,
+			"Authors":   authors,
+			"Isbn":      isbn,
+			"Exercise":  exercise,
+		})
 		if err != nil {
-			panic(fmt.Errorf("failed to drop database %w", err))
+			t.Fatal(err)
 		}
-		db.Close()
-	}
+		g.Equal(t, data)
+	})
 }
 
-func TestQuery(t *testing.T) {
-	type runner interface {
-		Run(context.Context, ...interface{}) error
-	}
+func TestValidate(t *testing.T) {
 	tests := []struct {
-		name   string
-		runner runner
-		wantErr bool
+		name    string
+		query   Query
+		wantErr string
 	}{
 		{
-			name: "should load from single query",
-			runner: NewQuery(testDB, `FROM textbooks t
-		LEFT JOIN isbns i ON i.textbook_id = t.textbook_id
-	   LEFT JOIN sections s on t.textbook_id = s.textbook_id
-		LEFT JOIN exercises e ON e.section_id = s.section_id
-		LEFT JOIN authors a ON a.author_id = t.author_id
-	   WHERE t.textbook_id in (?, ?)
-		ORDER BY t.textbook_id, i.isbn_id, s.section_id, e.exercise_id, a.author_id`, 1, 2).
-				AddModel(Textbook{}, "t").
-				AddModel(Isbn{}, "i").
-				AddModel(Section{}, "s").
-				AddModel(Exercise{}, "e").
-				AddModel(Author{}, "a"),
+			name: "should validate query",
+			query: NewQuery(testDB, `FROM tags tg`).
+				AddModel(Tag{}, "tg").
+				AddModel(&[]*Textbook{}, "").
+				AddJoinTable(Tag{}, "Textbooks", "tt"),
 		},
 		{
-			name: "should load from multi query",
-			runner: MultiQuery{
-				NewQuery(testDB, `FROM textbooks t
-	   LEFT JOIN sections s on t.textbook_id = s.textbook_id
-		LEFT JOIN exercises e ON e.section_id = s.section_id
-	   WHERE t.textbook_id in (?, ?)
-		ORDER BY t.textbook_id, s.section_id, e.exercise_id`, 1, 2).
-					AddModel(Textbook{}, "t").
-					AddModel(Section{}, "s").
-					AddModel(Exercise{}, "e"),
-
-				NewQuery(testDB, `FROM textbooks t
-		JOIN authors a ON a.author_id = t.author_id
-		WHERE t.textbook_id in (?, ?)
-		ORDER BY a.author_id`, 1, 2).
-					AddModel(&Author{}, "a"),
-
-				NewQuery(testDB, `FROM textbooks t
-		JOIN isbns i ON i.textbook_id = t.textbook_id
-		WHERE t.textbook_id in (?, ?)
-		ORDER BY i.isbn_id`, 1, 2).
-					AddModel(&Isbn{}, "i"),
-			},
+			name:    "should error if model is not a struct",
+			query:   NewQuery(testDB, `FROM tags tg`).AddModel(&[]int{}, "tg"),
+			wantErr: "model *[]int is not a struct",
 		},
 		{
-			name: "should use independent aliases in multi query",
-			runner: MultiQuery{
-				NewQuery(testDB, `FROM textbooks tb
-	   WHERE tb.textbook_id in (?)`, 1).
-					AddModel(&Textbook{}, "tb"),
-
-				NewQuery(testDB, `FROM textbooks t
-	   WHERE t.textbook_id in (?)`, 2).
-					AddModel(&Textbook{}, "t"),
-			},
+			name:    "should error if model has no primary key",
+			query:   NewQuery(testDB, `FROM tags tg`).AddModel(NoKey{}, "tg"),
+			wantErr: "model hydrate.NoKey has no primary key",
 		},
 		{
-			name: "should use table name as alias if not provided",
-			runner: NewQuery(testDB, `FROM textbooks
-	   WHERE textbook_id in (?)`, 1).AddModel(&Textbook{}, ""),
+			name:    "should error if alias is added twice",
+			query:   NewQuery(testDB, `FROM tags tg`).AddModel(Tag{}, "tg").AddModel(&Tag{}, "tg"),
+			wantErr: "alias tg is added more than once for hydrate.Tag",
 		},
 		{
-	   		name: "should error if query has error",
-			runner: NewQuery(testDB, `FROM textbooks
-	   WHERE not_a_column in (?)`, 1).AddModel(&Textbook{}, ""),
-	   		wantErr: true,
+			name:    "should error if alias is used by different types",
+			query:   NewQuery(testDB, `FROM textbooks`).AddModel(Textbook{}, "").AddModel(Tag{}, "textbooks"),
+			wantErr: "alias textbooks is used by both hydrate.Textbook and hydrate.Tag",
 		},
 		{
-			name: "should error if one multi query has error",
-			runner: MultiQuery{
-				NewQuery(testDB, `FROM textbooks tb
-	   WHERE tb.textbook_id in (?)`, 1).
-					AddModel(&Textbook{}, "tb"),
-				NewQuery(testDB, `FROM textbooks
-	   WHERE not_a_column in (?)`, 1).AddModel(&Textbook{}, ""),
-			},
-			wantErr: true,
+			name:    "should error if join table alias is used by a model",
+			query:   NewQuery(testDB, `FROM tags tg`).AddModel(Tag{}, "tg").AddJoinTable(Tag{}, "Textbooks", "tg"),
+			wantErr: "alias tg is used by both hydrate.Tag and join table hydrate.Tag.Textbooks",
 		},
 		{
-			name: "should error if struct can not scan into result",
-			runner: NewQuery(testDB, `FROM textbooks t
-	   WHERE textbook_id in (?)`, 1).AddModel(BadTextbook{}, "t"),
-	   wantErr: true,
+			name: "should error if template query uses WithRecursive",
+			query: NewTemplateQuery(testDB, `SELECT {{columns}} FROM tree JOIN tags tg ON tg.tag_id = tree.tag_id`).
+				WithRecursive(`tree AS (SELECT tag_id FROM tags)`).
+				AddModel(Tag{}, "tg"),
+			wantErr: "template queries can not use WithRecursive",
+		},
+		{
+			name:    "should error if tag relationship is not a struct",
+			query:   NewSQLQuery(testDB.DB(), `FROM textbooks t`).AddModel(NonStructRelSQLTextbook{}, "t"),
+			wantErr: "model hydrate.NonStructRelSQLTextbook: hydrate.NonStructRelSQLTextbook.Vals: rel must be on a struct field",
+		},
+		{
+			name: "should error if relationship is not a struct",
+			query: NewQueryWith(nonStructRelProvider{}, gormExecutor{testDB}, `FROM textbooks t`).
+				AddModel(NonStructRelSQLTextbook{}, "t"),
+			wantErr: "relationship hydrate.NonStructRelSQLTextbook.Vals: int is not a struct",
+		},
+		{
+			name:    "should error if join table is not of a many2many relationship",
+			query:   NewQuery(testDB, `FROM tags tg`).AddModel(Tag{}, "tg").AddJoinTable(Textbook{}, "Sections", "s"),
+			wantErr: "join table hydrate.Textbook.Sections",
 		},
 	}
 	for _, tt := range tests {
 		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
-			t.Parallel()
-			var textbooks []*Textbook //test slice array output
-			var authors []Author      //test slice struct output
-			var isbn *Isbn            //test ptr output
-			var exercise Exercise     //test struct output
-			err := tt.runner.Run(context.Background(), &textbooks, &authors, &isbn, &exercise)
-			if err != nil {
-				if !tt.wantErr {
+			err := tt.query.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
 					t.Error(err)
 				}
 				return
 			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("expected error %q, got %v", tt.wantErr, err)
+			}
 
-			if tt.wantErr {
-				t.Error(fmt.Errorf("expected error result from unassignable output variable"))
-				return
+			//the query is validated before it is run
+			if runErr := tt.query.Run(context.Background()); runErr == nil || runErr.Error() != err.Error() {
+				t.Errorf("expected validation error from run, got %v", runErr)
 			}
+		})
+	}
+}
+
+func TestModelOptions(t *testing.T) {
+	query := func(options ...ModelOption) Query {
+		return NewQuery(testDB, `FROM textbooks t
+		LEFT JOIN sections s ON s.textbook_id = t.textbook_id
+		WHERE t.textbook_id IN (?)
+		ORDER BY t.textbook_id, s.section_id`, []int{1, 2}).
+			AddModel(SectionLogTextbook{}, "t").
+			AddModel(SectionLog{}, "s", options...)
+	}
+
+	t.Run("should load every row without dedup", func(t *testing.T) {
+		var textbooks []*SectionLogTextbook
+		var logs []SectionLog
+		if err := query(NoDedup()).Run(context.Background(), &textbooks, &logs); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(logs) != 3 {
+			t.Errorf("expected a log for each section row, got %d", len(logs))
+		}
+		if len(textbooks) != 2 || len(textbooks[0].Logs) != 3 || len(textbooks[1].Logs) != 0 {
+			t.Errorf("expected logs to be linked to their textbook, got %+v", textbooks)
+		}
+	})
 
-			g := golden{Name: tt.name}
-			data, err := json.Marshal(map[string]interface{}{
-				"Textbooks": textbooks,
-				"Authors":   authors,
-				"Isbn":      isbn,
-				"Exercise":  exercise,
+	t.Run("should stream every row without dedup", func(t *testing.T) {
+		var titles []string
+		err := NewQuery(testDB, `FROM sections s ORDER BY s.section_id`).
+			AddModel(SectionLog{}, "s", NoDedup()).
+			Each(context.Background(), func(l *SectionLog) error {
+				titles = append(titles, l.Title)
+				return nil
 			})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Join(titles, ",") != "t1-s1,t1-s2,t1-s3" {
+			t.Errorf("expected each row to be streamed, got %v", titles)
+		}
+	})
+
+	t.Run("should combine rows by natural key", func(t *testing.T) {
+		var logs []SectionLog
+		if err := query(NaturalKey("TextbookID", "CreatedAt")).Run(context.Background(), &logs); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(logs) != 2 || logs[0].Title != "t1-s1" || logs[1].Title != "t1-s2" {
+			t.Errorf("expected the first section of each date, got %+v", logs)
+		}
+	})
+
+	t.Run("should error if model is loaded with other options in parallel", func(t *testing.T) {
+		err := MultiQuery{
+			query(NoDedup()),
+			query(NaturalKey("TextbookID", "CreatedAt")),
+		}.RunParallel(context.Background(), 2, &[]SectionLog{})
+		if err == nil || !strings.Contains(err.Error(), "multi query 1") {
+			t.Errorf("expected options of query 1 to conflict, got %v", err)
+		}
+	})
+
+	t.Run("should error if results with other options are merged", func(t *testing.T) {
+		res, err := query(NaturalKey("TextbookID", "CreatedAt")).RunResult(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := query(NoDedup()).RunResult(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := res.Merge(other); err == nil || !strings.Contains(err.Error(), "already loaded with other options") {
+			t.Errorf("expected options to conflict, got %v", err)
+		}
+		if n := Count[SectionLog](res); n != 2 {
+			t.Errorf("expected result to be unchanged, got %d logs", n)
+		}
+	})
+
+	t.Run("should error if model can not be keyed", func(t *testing.T) {
+		for _, q := range []Query{
+			query(),
+			query(NaturalKey("Name")),
+			query(NoDedup()).AddModel(SectionLog{}, "s2"),
+		} {
+			if err := q.Validate(); err == nil {
+				t.Error("expected error result")
+			}
+		}
+	})
+}
+
+func TestNullableKeys(t *testing.T) {
+	query := NewQuery(testDB, `FROM grants g ORDER BY g.account_id, g.region_id, g.name`)
+
+	t.Run("should identify items by keys with null parts", func(t *testing.T) {
+		res, err := query.AddModel(Grant{}, "g").RunResult(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, g := range All[Grant](res) {
+			names = append(names, g.Name)
+		}
+		if strings.Join(names, ",") != "g1,g1-r2,g2" {
+			t.Errorf("expected rows with all null keys to be absent, got %v", names)
+		}
+
+		for _, k := range []struct {
+			account interface{}
+			region  interface{}
+			name    string
+		}{
+			{1, nil, "g1"},
+			{1, 2, "g1-r2"},
+			{2, nil, "g2"},
+		} {
+			g, ok, err := ByKey[Grant](res, k.account, k.region)
+			if err != nil || !ok || g.Name != k.name {
+				t.Errorf("expected %s by key %v, %v, got %+v, %v", k.name, k.account, k.region, g, err)
+			}
+		}
+	})
 
+	t.Run("should key map outputs by nullable composite key", func(t *testing.T) {
+		type grantKey struct {
+			AccountID uint
+			RegionID  sql.NullInt64
+		}
+		byKey := map[grantKey]*Grant{}
+		if err := query.AddModel(Grant{}, "g").Run(context.Background(), &byKey); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(byKey) != 3 {
+			t.Errorf("expected 3 grants keyed by null region, got %+v", byKey)
+		}
+		for k, name := range map[grantKey]string{
+			{AccountID: 1}: "g1",
+			{AccountID: 1, RegionID: sql.NullInt64{Int64: 2, Valid: true}}: "g1-r2",
+			{AccountID: 2}: "g2",
+		} {
+			g, ok := byKey[k]
+			if !ok || g.Name != name || g.AccountID != k.AccountID || (g.RegionID != nil) != k.RegionID.Valid {
+				t.Errorf("expected %s by key %+v, got %+v", name, k, g)
+			}
+		}
+	})
+
+	t.Run("should identify items by sql null keys", func(t *testing.T) {
+		type grantKey struct {
+			AccountID sql.NullInt64
+			RegionID  sql.NullInt64
+		}
+		byKey := map[grantKey]NullGrant{}
+		if err := query.AddModel(NullGrant{}, "g").Run(context.Background(), &byKey); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(byKey) != 3 {
+			t.Errorf("expected 3 grants keyed by null region, got %+v", byKey)
+		}
+		for k, name := range map[grantKey]string{
+			{AccountID: sql.NullInt64{Int64: 1, Valid: true}}:                                                 "g1",
+			{AccountID: sql.NullInt64{Int64: 1, Valid: true}, RegionID: sql.NullInt64{Int64: 2, Valid: true}}: "g1-r2",
+			{AccountID: sql.NullInt64{Int64: 2, Valid: true}}:                                                 "g2",
+		} {
+			g, ok := byKey[k]
+			if !ok || g.Name != name || g.AccountID != k.AccountID || g.RegionID != k.RegionID {
+				t.Errorf("expected %s by key %+v, got %+v", name, k, g)
+			}
+		}
+	})
+
+	t.Run("should skip rows with any null key part", func(t *testing.T) {
+		var grants []Grant
+		if err := query.AddModel(Grant{}, "g", AnyNullKeyAbsent()).Run(context.Background(), &grants); err != nil {
+			t.Fatal(err)
+		}
+		if len(grants) != 1 || grants[0].Name != "g1-r2" {
+			t.Errorf("expected only g1-r2, got %+v", grants)
+		}
+	})
+}
+
+func TestModelMetadataCache(t *testing.T) {
+	var wg sync.WaitGroup
+	loaders := make([]*modelLoader, 10)
+	for i := range loaders {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			if i%2 == 0 {
+				loaders[i], err = newModelLoader(gormProvider{}, Textbook{}, modelOptions{})
+			} else {
+				loaders[i], err = newModelLoader(gormProvider{}, &[]*Textbook{}, modelOptions{})
+			}
 			if err != nil {
 				t.Error(err)
-				return
 			}
-			g.Equal(t, data)
-		})
+		}(i)
 	}
+	wg.Wait()
 
-	t.Run("should error if output can not be assigned", func(t *testing.T) {
-		var tb Textbook
-		err := NewQuery(testDB, `FROM textbooks t
-	  WHERE textbook_id in (?)`, 1).AddModel(&Textbook{}, "t").Run(context.Background(), tb)
+	for _, l := range loaders[1:] {
+		if l.modelMetadata != loaders[0].modelMetadata {
+			t.Error("expected metadata to be shared by all loaders of a type")
+		}
+		if l == loaders[0] {
+			t.Error("expected a new loader for each call")
+		}
+	}
+}
 
-		if err == nil {
-			t.Error(fmt.Errorf("expected error result from unassignable output variable"))
+func TestKeys(t *testing.T) {
+	one := uint(1)
+	type test struct {
+		name  string
+		a, b  []interface{}
+		equal bool
+	}
+	tests := []test{
+		{"int types", []interface{}{uint(1)}, []interface{}{int64(1)}, true},
+		{"pointer", []interface{}{&one}, []interface{}{1}, true},
+		{"valuer", []interface{}{sql.NullInt64{Int64: 1, Valid: true}}, []interface{}{uint32(1)}, true},
+		{"string and int", []interface{}{"1"}, []interface{}{1}, false},
+		{"bytes and string", []interface{}{[]byte("a")}, []interface{}{"a"}, true},
+		{"composite", []interface{}{1, "a"}, []interface{}{int8(1), "a"}, true},
+		{"composite order", []interface{}{1, 2}, []interface{}{2, 1}, false},
+		{"large composite", []interface{}{1, 2, 3, 4, 5}, []interface{}{1, 2, 3, 4, 5}, true},
+	}
+
+	build := func(vals []interface{}) key {
+		rvals := make([]reflect.Value, 0, len(vals))
+		for _, v := range vals {
+			rvals = append(rvals, reflect.ValueOf(v))
 		}
-	})
+		k, ok, err := valuesKey(rvals)
+		if err != nil || !ok {
+			t.Fatalf("expected key for %v: %v", vals, err)
+		}
+		return k
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if equal := build(test.a) == build(test.b); equal != test.equal {
+				t.Errorf("expected keys %v and %v equal: %t", test.a, test.b, test.equal)
+			}
+		})
+	}
+
+	if _, ok, _ := valuesKey([]reflect.Value{reflect.ValueOf(1), reflect.ValueOf(sql.NullInt64{})}); ok {
+		t.Error("expected no key when a value is null")
+	}
+}
+
+//parallelMultiQuery will run a MultiQuery using RunParallel
+type parallelMultiQuery struct {
+	query   MultiQuery
+	workers int
+}
+
+func (p parallelMultiQuery) Run(ctx context.Context, output ...interface{}) error {
+	return p.query.RunParallel(ctx, p.workers, output...)
 }
 
 /**
@@ -405,6 +1653,36 @@ func BenchmarkHydrate(b *testing.B) {
 				}.Run(context.Background(), &Textbook{})
 			},
 		},
+		{
+			name: "Plan",
+			runner: func(textbookID uint) error {
+				q, err := From(testDB, &Textbook{}).
+					Join("Isbns").
+					Join("Sections.Exercises").
+					Join("AuthorPtr").
+					Where("t.textbook_id in (?)", textbookID).
+					Plan()
+				if err != nil {
+					return err
+				}
+				return q.Run(context.Background(), &Textbook{})
+			},
+		},
+		{
+			name: "Union",
+			runner: func(textbookID uint) error {
+				q, err := From(testDB, &Textbook{}).
+					Join("Isbns").
+					Join("Sections.Exercises").
+					Join("AuthorPtr").
+					Where("t.textbook_id in (?)", textbookID).
+					Union()
+				if err != nil {
+					return err
+				}
+				return q.Run(context.Background(), &Textbook{})
+			},
+		},
 	}
 	for _, c := range configs {
 		textbookID := generateHierarchy(testDB, c.sections, c.exercises, c.isbns)
@@ -478,6 +1756,79 @@ type BadTextbook struct {
 	Name       sql.NullInt64
 }
 
+type SectionLogTextbook struct {
+	TextbookID uint `gorm:"primary_key"`
+
+	Logs []SectionLog `gorm:"foreignkey:TextbookID;association_foreignkey:TextbookID"`
+}
+
+func (SectionLogTextbook) TableName() string {
+	return "textbooks"
+}
+
+//SectionLog has no primary key, to test model options
+type SectionLog struct {
+	TextbookID uint
+	Title      string
+	CreatedAt  *time.Time
+}
+
+func (SectionLog) TableName() string {
+	return "sections"
+}
+
+//Grant has a composite key with nullable parts
+type Grant struct {
+	AccountID uint  `gorm:"primary_key"`
+	RegionID  *uint `gorm:"primary_key"`
+	Name      string
+}
+
+type NullGrant struct {
+	AccountID sql.NullInt64 `gorm:"primary_key"`
+	RegionID  sql.NullInt64 `gorm:"primary_key"`
+	Name      string
+}
+
+func (NullGrant) TableName() string {
+	return "grants"
+}
+
+type NoKey struct {
+	Name string
+}
+
+type TextbookTag struct {
+	TextbookID uint `gorm:"primary_key"`
+	TagID      uint `gorm:"primary_key"`
+}
+
+type Tag struct {
+	TagID uint `gorm:"primary_key"`
+	Name  string
+
+	Textbooks []*Textbook `gorm:"many2many:textbook_tags;jointable_foreignkey:tag_id;association_jointable_foreignkey:textbook_id"`
+}
+
+type Category struct {
+	CategoryID uint `gorm:"primary_key"`
+	ParentID   *uint
+	Name       string
+
+	Children []*Category `gorm:"foreignkey:ParentID;association_foreignkey:CategoryID"`
+}
+
+type Review struct {
+	ReviewID   uint `gorm:"primary_key"`
+	TextbookID uint
+	WriterID   uint
+	ReviewerID uint
+	Text       string
+
+	Writer   *Author `gorm:"foreignkey:WriterID;association_foreignkey:AuthorID"`
+	Reviewer *Author `gorm:"foreignkey:ReviewerID;association_foreignkey:AuthorID"`
+}
+
 type Isbn struct {
 	IsbnID     uint `gorm:"primary_key"`
 	TextbookID sql.NullInt64
@@ -500,3 +1851,75 @@ type Exercise struct {
 	Title      string
 	CreatedAt  *time.Time
 }
+
+type SQLAuthor struct {
+	AuthorID uint `hydrate:"pk"`
+	Name     string
+}
+
+func (SQLAuthor) TableName() string {
+	return "authors"
+}
+
+type SQLTextbook struct {
+	TextbookID uint `hydrate:"pk"`
+	AuthorID   *uint
+	Name       string
+	Created    time.Time `hydrate:"column=created_at"`
+
+	Author   *SQLAuthor    `hydrate:"rel=AuthorID:AuthorID"`     //tests belongs to
+	Sections []*SQLSection `hydrate:"rel=TextbookID:TextbookID"` //tests has many
+	Tags     []SQLTag      `hydrate:"rel=TextbookID:TagID;join=textbook_tags;join_columns=textbook_id:tag_id"`
+}
+
+func (SQLTextbook) TableName() string {
+	return "textbooks"
+}
+
+//Bad SQLTextbook with a relationship to a field that doesn't exist
+type BadSQLTextbook struct {
+	TextbookID uint `hydrate:"pk"`
+
+	Sections []*SQLSection `hydrate:"rel=TextbookID:BookID"`
+}
+
+type NonStructRelSQLTextbook struct {
+	TextbookID uint `hydrate:"pk"`
+
+	Vals []int `hydrate:"rel=TextbookID:X"`
+}
+
+//nonStructRelProvider loads models with a relationship to every field that isn't a column
+type nonStructRelProvider struct{}
+
+func (nonStructRelProvider) Model(t reflect.Type) (*Model, error) {
+	ret := Model{Type: t}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get("hydrate") == "pk" {
+			ret.Fields = append(ret.Fields, Field{Name: f.Name, Column: snakeCase(f.Name), Type: f.Type, PrimaryKey: true})
+			continue
+		}
+		ret.Relationships = append(ret.Relationships, Relationship{Field: f.Name, Kind: HasMany, ForeignFields: []string{"X"}, AssociationFields: []string{"TextbookID"}})
+	}
+	return &ret, nil
+}
+
+type SQLSection struct {
+	SectionID  uint `hydrate:"pk"`
+	TextbookID uint
+	Title      string
+}
+
+func (SQLSection) TableName() string {
+	return "sections"
+}
+
+type SQLTag struct {
+	TagID uint `hydrate:"pk"`
+	Name  string
+}
+
+func (SQLTag) TableName() string {
+	return "tags"
+}
@@ -1,4 +1,5 @@
-package hydrate
+//Package golden compares test output with golden files, shared by the tests of hydrate and its nested modules
+package golden
 
 import (
 	"bytes"
@@ -20,13 +21,13 @@ func GetUpdateFlag() bool {
 
 var patternNonAlphanumeric = regexp.MustCompile("[^A-Za-z0-9]")
 
-// golden provides a way to read canned data from golden files as well as updating the files with new data.
-type golden struct {
+// File provides a way to read canned data from golden files as well as updating the files with new data.
+type File struct {
 	Name   string
-	update *bool
+	Update *bool
 }
 
-func (g golden) Write(data []byte) error {
+func (g File) Write(data []byte) error {
 	golden := g.GetFilename()
 	err := ioutil.WriteFile(golden, data, 0644)
 	if err != nil {
@@ -35,7 +36,7 @@ func (g golden) Write(data []byte) error {
 	return nil
 }
 
-func (g golden) Read() ([]byte, error) {
+func (g File) Read() ([]byte, error) {
 	golden := g.GetFilename()
 	data, err := ioutil.ReadFile(golden)
 	if err != nil {
@@ -44,15 +45,15 @@ func (g golden) Read() ([]byte, error) {
 	return data, nil
 }
 
-func (g golden) GetFilename() string {
+func (g File) GetFilename() string {
 	return "testdata/" + patternNonAlphanumeric.ReplaceAllString(g.Name, "-") + ".golden"
 }
 
 // Equal will determine if the actual received content matches the value in the golden flag.
 // If the update flag is provided when testing, it will update the value stored in the golden flag to match the
 // content provided in actual
-func (g golden) Equal(t *testing.T, actual []byte) bool {
-	if (g.update == nil && GetUpdateFlag()) || (g.update != nil && *g.update) {
+func (g File) Equal(t *testing.T, actual []byte) bool {
+	if (g.Update == nil && GetUpdateFlag()) || (g.Update != nil && *g.Update) {
 		buffer := bytes.Buffer{}
 		_ = json.Indent(&buffer, actual, "", "\t")
 		goldenData := buffer.Bytes()
@@ -0,0 +1,76 @@
+package golden
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+//Runner is a query that can be run into outputs, such as a hydrate Query, MultiQuery or Builder
+type Runner interface {
+	Run(context.Context, ...interface{}) error
+}
+
+//RunnerFunc is a func used as a Runner, ie. to run the MultiQuery planned by a Builder
+type RunnerFunc func(context.Context, ...interface{}) error
+
+//Run will call f
+func (f RunnerFunc) Run(ctx context.Context, output ...interface{}) error {
+	return f(ctx, output...)
+}
+
+//Test runs a query and compares its outputs with the golden file of its name
+type Test struct {
+	Name    string
+	Runner  Runner
+	WantErr bool
+}
+
+//RunTests will run each test in parallel into the outputs returned by outputs, which are keyed by the name each output
+//is encoded with, and compare the outputs with the golden file of the test. If wrap is given each output is passed to
+//Run through it, ie. hydrate.Optional.
+func RunTests(t *testing.T, tests []Test, wrap func(interface{}) interface{}, outputs func() map[string]interface{}) {
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			t.Parallel()
+			out := outputs()
+			names := make([]string, 0, len(out))
+			for name := range out {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			args := make([]interface{}, 0, len(out))
+			for _, name := range names {
+				if wrap != nil {
+					args = append(args, wrap(out[name]))
+					continue
+				}
+				args = append(args, out[name])
+			}
+			err := tt.Runner.Run(context.Background(), args...)
+			if err != nil {
+				if !tt.WantErr {
+					t.Error(err)
+				}
+				return
+			}
+
+			if tt.WantErr {
+				t.Error(fmt.Errorf("expected error result"))
+				return
+			}
+
+			g := File{Name: tt.Name}
+			data, err := json.Marshal(out)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			g.Equal(t, data)
+		})
+	}
+}
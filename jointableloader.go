@@ -0,0 +1,266 @@
+package hydrate
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+//joinTableConfiguration is used to define how the join table of a many2many relationship is used in a query.
+type joinTableConfiguration struct {
+	//example is an example of the type defining the relationship
+	example interface{}
+	//relationship is the name of the many2many field
+	relationship string
+	//alias is the alias of the join table to use within a query
+	alias string
+}
+
+//key will return the joinKey identifying the relationship of the configuration
+func (c joinTableConfiguration) key() joinKey {
+	return joinKey{baseType(reflect.TypeOf(c.example)), c.relationship}
+}
+
+//joinKey identifies a many2many relationship by the type defining it and the name of its field
+type joinKey struct {
+	modelType    reflect.Type
+	relationship string
+}
+
+//joinTableMetadataCache holds the joinTableMetadata of each relationship loaded, keyed by joinMetadataKey
+var joinTableMetadataCache sync.Map
+
+//joinMetadataKey identifies the metadata of a many2many relationship loaded from a provider
+type joinMetadataKey struct {
+	provider Provider
+	joinKey
+}
+
+//joinTableMetadata holds all information about a join table that does not change between runs. Like modelMetadata it
+//is cached and must not be modified once created.
+type joinTableMetadata struct {
+	key joinKey
+	//model is the metadata of the model defining the relationship
+	model *Model
+	//table is the join table given by the provider
+	table string
+
+	//columns holds the join table columns selected, source keys followed by destination keys
+	columns []string
+	//sourceFields holds the names of the fields on the source model referenced by the join table
+	sourceFields []string
+	//destinationFields holds the names of the fields on the destination model referenced by the join table
+	destinationFields []string
+	//sourceType and destinationType are the types of both sides of the relationship
+	sourceType, destinationType reflect.Type
+	//types holds the type of the field referenced by each column
+	types []reflect.Type
+}
+
+//joinTableLoader provides functionality for loading the rows of a many2many join table so both sides of the
+//relationship can be linked when finalizing
+type joinTableLoader struct {
+	*joinTableMetadata
+
+	//links holds the keys of all destinations, in order received, for each source key
+	links map[key][]key
+	//storedLinks will record which source and destination key pairs are held in links
+	storedLinks map[[2]key]struct{}
+
+	scanValues []interface{}
+	fields     []reflect.Value
+}
+
+//newJoinTableLoaders is the default implementation for getting joinTableLoaders from a join table definition. This
+//will create new loaders on each call.
+func newJoinTableLoaders(provider Provider, tables []joinTableConfiguration) ([]*joinTableLoader, []string, error) {
+	ret := make([]*joinTableLoader, 0, len(tables))
+	aliases := make([]string, 0, len(tables))
+	for _, t := range tables {
+		j, err := newJoinTableLoader(provider, t.example, t.relationship)
+		if err != nil {
+			return nil, nil, err
+		}
+		ret = append(ret, j)
+		aliases = append(aliases, t.alias)
+	}
+	return ret, aliases, nil
+}
+
+//newJoinTableLoader will instantiate a new join table loader for the many2many relationship of the model given
+func newJoinTableLoader(provider Provider, in interface{}, relationship string) (*joinTableLoader, error) {
+	metadata, err := getJoinTableMetadata(provider, in, relationship)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := joinTableLoader{
+		joinTableMetadata: metadata,
+		links:             make(map[key][]key),
+		storedLinks:       make(map[[2]key]struct{}),
+	}
+
+	ret.scanValues = make([]interface{}, 0, len(metadata.types))
+	ret.fields = make([]reflect.Value, 0, len(metadata.types))
+	for _, t := range metadata.types {
+		//scan into the type of the referenced field so keys build the same as they do from loaded items
+		newValue := reflect.New(reflect.PtrTo(t))
+		ret.fields = append(ret.fields, newValue)
+		ret.scanValues = append(ret.scanValues, newValue.Interface())
+	}
+
+	return &ret, nil
+}
+
+//getJoinTableMetadata will return the metadata of a many2many relationship, loading it if it's not already cached
+func getJoinTableMetadata(provider Provider, in interface{}, relationship string) (*joinTableMetadata, error) {
+	k := joinMetadataKey{provider, joinKey{baseType(reflect.TypeOf(in)), relationship}}
+	if j, ok := joinTableMetadataCache.Load(k); ok {
+		return j.(*joinTableMetadata), nil
+	}
+
+	metadata, err := newJoinTableMetadata(provider, in, relationship)
+	if err != nil {
+		return nil, err
+	}
+	j, _ := joinTableMetadataCache.LoadOrStore(k, metadata)
+	return j.(*joinTableMetadata), nil
+}
+
+//newJoinTableMetadata will load the metadata of a many2many relationship from the metadata of the model defining it
+func newJoinTableMetadata(provider Provider, in interface{}, relationship string) (*joinTableMetadata, error) {
+	source, err := getModelMetadata(provider, in)
+	if err != nil {
+		return nil, err
+	}
+
+	var rel *relationshipMetadata
+	for i, r := range source.relationships {
+		if r.Field == relationship {
+			rel = &source.relationships[i]
+			break
+		}
+	}
+	if rel == nil || rel.Kind != ManyToMany || rel.JoinTable == nil {
+		return nil, fmt.Errorf("%s has no many2many relationship %s", source.itemType, relationship)
+	}
+
+	ret := joinTableMetadata{
+		key:               joinKey{source.itemType, relationship},
+		model:             source.model,
+		table:             rel.JoinTable.Table,
+		sourceType:        source.itemType,
+		destinationType:   rel.relatedType,
+		sourceFields:      rel.AssociationFields,
+		destinationFields: rel.ForeignFields,
+	}
+	ret.columns = append(ret.columns, rel.JoinTable.SourceColumns...)
+	ret.columns = append(ret.columns, rel.JoinTable.DestinationColumns...)
+
+	//scan into the types of the fields referenced so keys build the same as they do from loaded items
+	for _, name := range ret.sourceFields {
+		f, ok := ret.sourceType.FieldByName(name)
+		if !ok {
+			return nil, fmt.Errorf("%s has no field %s", ret.sourceType, name)
+		}
+		ret.types = append(ret.types, f.Type)
+	}
+	for _, name := range ret.destinationFields {
+		f, ok := ret.destinationType.FieldByName(name)
+		if !ok {
+			return nil, fmt.Errorf("%s has no field %s", ret.destinationType, name)
+		}
+		ret.types = append(ret.types, f.Type)
+	}
+	if len(ret.columns) != len(ret.types) {
+		return nil, fmt.Errorf("%s many2many relationship %s has %d columns for %d fields", ret.sourceType, relationship,
+			len(ret.columns), len(ret.types))
+	}
+
+	return &ret, nil
+}
+
+//getAlias will return the alias to use for this join table, which is the table name if no alias was provided
+func (j joinTableMetadata) getAlias(e Executor, alias string) string {
+	if alias != "" {
+		return alias
+	}
+	if namer, ok := e.(tableNamer); ok {
+		return namer.joinTableName(j.model, j.key.relationship)
+	}
+	return j.table
+}
+
+//getSelectStatement will return the select statement to use for this join table
+func (j joinTableMetadata) getSelectStatement(e Executor, alias string) string {
+	alias = j.getAlias(e, alias)
+
+	selects := make([]string, 0, len(j.columns))
+	for _, c := range j.columns {
+		selects = append(selects, fmt.Sprintf("%s.%s", alias, c))
+	}
+
+	return strings.Join(selects, ",")
+}
+
+//describeColumns will return a ScanError describing each column selected for this join table
+func (j joinTableMetadata) describeColumns(e Executor, alias string) []ScanError {
+	alias = j.getAlias(e, alias)
+
+	ret := make([]ScanError, 0, len(j.columns))
+	for i, c := range j.columns {
+		model, field := j.sourceType, ""
+		if i < len(j.sourceFields) {
+			field = j.sourceFields[i]
+		} else {
+			model, field = j.destinationType, j.destinationFields[i-len(j.sourceFields)]
+		}
+		ret = append(ret, ScanError{Alias: alias, Model: model.Name(), Field: field, Column: c})
+	}
+	return ret
+}
+
+//processScan will record the link held by the scanned row
+func (j *joinTableLoader) processScan() error {
+	sourceCount := len(j.sourceFields)
+
+	source, ok, err := valuesKey(j.fields[:sourceCount])
+	if err != nil || !ok {
+		//if any key is nil we should be in a failed left join, skip row
+		return err
+	}
+	destination, ok, err := valuesKey(j.fields[sourceCount:])
+	if err != nil || !ok {
+		return err
+	}
+
+	j.addLink(source, destination)
+	return nil
+}
+
+//addLink will add a link between a source and destination key if it's not already held
+func (j *joinTableLoader) addLink(source, destination key) {
+	link := [2]key{source, destination}
+	if _, ok := j.storedLinks[link]; ok {
+		return
+	}
+
+	j.links[source] = append(j.links[source], destination)
+	j.storedLinks[link] = struct{}{}
+}
+
+//merge will add all links held by other that are not already stored in j
+func (j *joinTableLoader) merge(other *joinTableLoader) {
+	for source, destinations := range other.links {
+		for _, destination := range destinations {
+			j.addLink(source, destination)
+		}
+	}
+}
+
+//reset will release all links held
+func (j *joinTableLoader) reset() {
+	j.links = make(map[key][]key)
+	j.storedLinks = make(map[[2]key]struct{})
+}
@@ -0,0 +1,179 @@
+package hydrate
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+//key is a comparable value used to identify an item in an identity map or to match a relationship. A key for a single
+//value is the normalized value itself, and a key for multiple values is a fixed size array of the normalized values.
+//This allows keys to be used in maps without formatting values into strings, and values of different kinds (ie. "1"
+//and 1) never build the same key.
+type key interface{}
+
+//timeKey is used as the key of a time so the same instant in different locations builds the same key
+type timeKey int64
+
+//formattedKey is used as the key of values that are not comparable. It is a distinct type so a formatted value never
+//matches a string value.
+type formattedKey string
+
+var interfaceType = reflect.TypeOf((*interface{})(nil)).Elem()
+
+//rowKey identifies an item loaded from a single row, for models loaded without combining rows. The loader is held so
+//keys stay unique when loaders are merged.
+type rowKey struct {
+	loader *modelLoader
+	row    int
+}
+
+//keyValue will normalize a value so it can be used in a key. Pointers are followed and values implementing
+//driver.Valuer are converted, then all integers are held as int64 (or uint64 if too large) and floats as float64 so
+//the same value held in different types, ie. uint and sql.NullInt64, builds the same key. If the value is nil no key
+//can be built.
+func keyValue(val reflect.Value) (key, bool, error) {
+	for val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface {
+		if val.IsNil() {
+			return nil, false, nil
+		}
+		val = val.Elem()
+	}
+
+	v := val.Interface()
+	if val.CanAddr() {
+		//values implementing driver.Valuer with a pointer receiver are only found through their address
+		if _, ok := v.(driver.Valuer); !ok {
+			v = val.Addr().Interface()
+		}
+	}
+	if valuer, ok := v.(driver.Valuer); ok {
+		v, err := valuer.Value()
+		if err != nil || v == nil {
+			return nil, false, err
+		}
+		val = reflect.ValueOf(v)
+	}
+
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return val.Int(), true, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if u := val.Uint(); u > math.MaxInt64 {
+			return u, true, nil
+		}
+		return int64(val.Uint()), true, nil
+	case reflect.Float32, reflect.Float64:
+		return val.Float(), true, nil
+	case reflect.String:
+		return val.String(), true, nil
+	case reflect.Slice:
+		if val.Type().Elem().Kind() == reflect.Uint8 {
+			//bytes are held as a string so they are comparable
+			return string(val.Bytes()), true, nil
+		}
+	}
+
+	v = val.Interface()
+	if t, ok := v.(time.Time); ok {
+		return timeKey(t.UnixNano()), true, nil
+	}
+	if !val.Type().Comparable() {
+		return formattedKey(fmt.Sprintf("%v", v)), true, nil
+	}
+	return v, true, nil
+}
+
+//valuesKey will build a key from the values given. If any value is nil no key is built, as null never identifies an
+//item or matches a relationship.
+func valuesKey(vals []reflect.Value) (key, bool, error) {
+	if len(vals) == 1 {
+		//fast path for the most common single column key
+		return keyValue(vals[0])
+	}
+
+	keys := make([]interface{}, len(vals))
+	for i, val := range vals {
+		k, ok, err := keyValue(val)
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		keys[i] = k
+	}
+
+	return compositeKey(keys), true, nil
+}
+
+//nullKey is held for a null part of a composite identity key, so rows with the same null parts identify the same item
+type nullKey struct{}
+
+//identityKey will build the key identifying an item from the values of its key fields. Unlike valuesKey a composite
+//key may hold null parts, and the item is only absent if every value is nil, or any value if anyNullAbsent is set.
+//Invalid values are treated as nil.
+func identityKey(vals []reflect.Value, anyNullAbsent bool) (key, bool, error) {
+	if len(vals) == 1 && vals[0].IsValid() {
+		return keyValue(vals[0])
+	}
+
+	keys := make([]interface{}, len(vals))
+	var nulls int
+	for i, val := range vals {
+		var k key
+		ok := false
+		if val.IsValid() {
+			var err error
+			if k, ok, err = keyValue(val); err != nil {
+				return nil, false, err
+			}
+		}
+		if !ok {
+			if anyNullAbsent {
+				return nil, false, nil
+			}
+			k = nullKey{}
+			nulls++
+		}
+		keys[i] = k
+	}
+	if nulls == len(vals) {
+		return nil, false, nil
+	}
+
+	if len(keys) == 1 {
+		return keys[0], true, nil
+	}
+	return compositeKey(keys), true, nil
+}
+
+//fieldsKey will build a key from the fields of a struct value with the given names
+func fieldsKey(itemVal reflect.Value, names []string) (key, bool, error) {
+	if len(names) == 1 {
+		return keyValue(itemVal.FieldByName(names[0]))
+	}
+
+	vals := make([]reflect.Value, 0, len(names))
+	for _, name := range names {
+		vals = append(vals, itemVal.FieldByName(name))
+	}
+	return valuesKey(vals)
+}
+
+//compositeKey will hold normalized values in a fixed size array so they can be compared as one key
+func compositeKey(keys []interface{}) key {
+	switch len(keys) {
+	case 2:
+		return [2]interface{}{keys[0], keys[1]}
+	case 3:
+		return [3]interface{}{keys[0], keys[1], keys[2]}
+	case 4:
+		return [4]interface{}{keys[0], keys[1], keys[2], keys[3]}
+	}
+
+	arr := reflect.New(reflect.ArrayOf(len(keys), interfaceType)).Elem()
+	for i, k := range keys {
+		arr.Index(i).Set(reflect.ValueOf(k))
+	}
+	return arr.Interface()
+}
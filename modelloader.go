@@ -1,75 +1,212 @@
 package hydrate
 
 import (
-	"database/sql/driver"
 	"fmt"
 	"reflect"
 	"strings"
-
-	"github.com/jinzhu/gorm"
+	"sync"
 )
 
-//modelLoader provides functionality for loading and storing a given model
-type modelLoader struct {
-	//itemType is the reflected type held by the modelLoader
+//metadataCache holds the modelMetadata of each type loaded, keyed by metadataKey
+var metadataCache sync.Map
+
+//metadataKey identifies the metadata of a model type loaded from a provider
+type metadataKey struct {
+	provider  Provider
+	modelType reflect.Type
+}
+
+//modelMetadata holds all information about a model that does not change between runs. It is cached for each type and
+//shared by all modelLoaders of the type, so it must not be modified once created.
+type modelMetadata struct {
+	//model is the metadata given by the provider
+	model *Model
+	//itemType is the reflected type of the model
 	itemType reflect.Type
-	//ms is the gorm.ModelStruct of the type being loaded
-	ms *gorm.ModelStruct
 
 	//selectFields holds a reference to all fields used when selecting
-	selectFields []*gorm.StructField
+	selectFields []Field
 	//keyFields holds all fields that represent the primary key of the model
-	keyFields []*gorm.StructField
+	keyFields []Field
+	//keyIndexes holds the index within selectFields of each key field
+	keyIndexes []int
 	//relationships holds all relationships that can be loaded in the model
-	relationships []*gorm.StructField
+	relationships []relationshipMetadata
+
+	//selects caches the select statement built for each alias
+	selects sync.Map
+}
+
+//relationshipMetadata is a relationship of a model along with the type of the related model
+type relationshipMetadata struct {
+	Relationship
+	relatedType reflect.Type
+}
+
+//modelLoader provides functionality for loading and storing a given model. A modelLoader holds a single identity map
+//for its type, which is filled by one aliasLoader for each alias the type is selected with.
+type modelLoader struct {
+	*modelMetadata
+
+	//options configure how items are identified
+	options modelOptions
+	//keyFields and keyIndexes identify items, which are those of the primary key unless a natural key is configured
+	keyFields  []Field
+	keyIndexes []int
+	//rows counts the rows scanned when every row is loaded as its own item
+	rows int
 
 	//items hold a flat list in order received of the structs loaded
 	items []interface{}
-	//storedKeys will record which primary keys are held in our item map
-	storedKeys map[string]struct{}
+	//storedKeys will record which primary keys are held in our item map, along with the index of the item in items
+	storedKeys map[key]int
+	//keys holds the primary key of each item, in the same order as items
+	keys []key
+
+	//rooted is set when only items scanned for a root alias should be output
+	rooted bool
+	//rootKeys holds the primary key of each item scanned for a root alias, in the order first scanned
+	rootKeys []key
+	//storedRoots records which primary keys are held in rootKeys
+	storedRoots map[key]struct{}
+
+	//tree is set when only items without a loaded parent of their own type should be output
+	tree bool
+	//children records the items linked as the child of an item of the same type during finalize
+	children map[interface{}]struct{}
+}
+
+//aliasLoader provides functionality for scanning the fields selected for a single alias of a query into the
+//modelLoader of its type
+type aliasLoader struct {
+	*modelLoader
+	//alias is the alias of the model within the query
+	alias string
+	//root is set when the alias defines which items of the type are output
+	root bool
+	//row is the count of the modelLoader when the current row was scanned, identifying its item without dedup
+	row int
 
 	scanValues []interface{}
 	fields     []reflect.Value
 }
 
-//newModelLoader will instantiate a new model loader with metadata loaded
-func newModelLoader(in interface{}) *modelLoader {
-	var ret modelLoader
+//newModelLoader will instantiate a new model loader using the cached metadata of the model
+func newModelLoader(provider Provider, in interface{}, options modelOptions) (*modelLoader, error) {
+	metadata, err := getModelMetadata(provider, in)
+	if err != nil {
+		return nil, err
+	}
 
-	s := &gorm.Scope{Value: in}
-	//get the gorm model struct so we can leverage gorm for DB and relationship information
-	ms := s.GetModelStruct()
+	ret := modelLoader{
+		modelMetadata: metadata,
+		options:       options,
+		keyFields:     metadata.keyFields,
+		keyIndexes:    metadata.keyIndexes,
+		storedKeys:    make(map[key]int),
+	}
+	switch {
+	case options.noDedup:
+		ret.keyFields, ret.keyIndexes = nil, nil
+	case len(options.naturalKey) > 0:
+		if ret.keyFields, ret.keyIndexes, err = metadata.naturalKey(options.naturalKey); err != nil {
+			return nil, err
+		}
+	}
+	return &ret, nil
+}
 
-	//construct metadata fields we need from all struct fields
-	for _, f := range ms.StructFields {
-		if f.Relationship != nil {
-			//track all relationships so we can map them later
-			ret.relationships = append(ret.relationships, f)
+//naturalKey will return the selected fields with the given names, and their index within selectFields
+func (m *modelMetadata) naturalKey(names []string) ([]Field, []int, error) {
+	fields := make([]Field, 0, len(names))
+	indexes := make([]int, 0, len(names))
+	for _, name := range names {
+		i := -1
+		for j, f := range m.selectFields {
+			if f.Name == name {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			return nil, nil, fmt.Errorf("natural key field %s of %s is not selected", name, m.itemType)
 		}
+		fields = append(fields, m.selectFields[i])
+		indexes = append(indexes, i)
+	}
+	return fields, indexes, nil
+}
 
-		if !f.IsNormal {
-			//if it's not a relationship and not a normal field we don't care about it
-			continue
+//getModelMetadata will return the metadata of a model, loading it from the provider if it's not already cached
+func getModelMetadata(provider Provider, in interface{}) (*modelMetadata, error) {
+	k := metadataKey{provider, baseType(reflect.TypeOf(in))}
+	if m, ok := metadataCache.Load(k); ok {
+		return m.(*modelMetadata), nil
+	}
+
+	metadata, err := newModelMetadata(provider, k.modelType)
+	if err != nil {
+		return nil, err
+	}
+	//if metadata is loaded concurrently for the same type only one is kept
+	m, _ := metadataCache.LoadOrStore(k, metadata)
+	return m.(*modelMetadata), nil
+}
+
+//newModelMetadata will load the metadata of a model from the provider
+func newModelMetadata(provider Provider, modelType reflect.Type) (*modelMetadata, error) {
+	model, err := provider.Model(modelType)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := modelMetadata{
+		model:    model,
+		itemType: model.Type,
+	}
+
+	for _, r := range model.Relationships {
+		relatedType, err := model.fieldType(r.Field)
+		if err != nil {
+			return nil, err
 		}
+		//track all relationships so we can map them later
+		ret.relationships = append(ret.relationships, relationshipMetadata{r, baseType(relatedType)})
+	}
 
-		if f.IsPrimaryKey {
+	for _, f := range model.Fields {
+		if f.PrimaryKey {
 			//track primary keys so we can track which items we've already processed
 			ret.keyFields = append(ret.keyFields, f)
+			ret.keyIndexes = append(ret.keyIndexes, len(ret.selectFields))
 		}
 		ret.selectFields = append(ret.selectFields, f)
 	}
 
-	ret.itemType = ms.ModelType
-	ret.ms = ms
-	ret.storedKeys = make(map[string]struct{})
+	return &ret, nil
+}
 
-	ret.scanValues = make([]interface{}, 0, len(ret.selectFields))
-	ret.fields = make([]reflect.Value, 0, len(ret.selectFields))
-	for _, f := range ret.selectFields {
+//newAliasLoader will instantiate a loader scanning the given alias into m
+func (m *modelLoader) newAliasLoader(alias string) *aliasLoader {
+	ret := aliasLoader{
+		modelLoader: m,
+		alias:       alias,
+	}
+
+	ret.scanValues = make([]interface{}, 0, len(m.selectFields))
+	ret.fields = make([]reflect.Value, 0, len(m.selectFields))
+	for _, f := range m.selectFields {
+		if f.Scan != nil {
+			//the field controls how it's scanned
+			scan := f.Scan()
+			ret.fields = append(ret.fields, reflect.ValueOf(scan))
+			ret.scanValues = append(ret.scanValues, scan)
+			continue
+		}
 
 		//we need to create a new value not tied to the struct that addresses the type given.
 		//this allows the scan to always succeed and not fail if we get a null back for a non-nullable field
-		newValue := reflect.New(reflect.PtrTo(f.Struct.Type))
+		newValue := reflect.New(reflect.PtrTo(f.Type))
 		ret.fields = append(ret.fields, newValue)
 		ret.scanValues = append(ret.scanValues, newValue.Interface())
 	}
@@ -77,53 +214,134 @@ func newModelLoader(in interface{}) *modelLoader {
 	return &ret
 }
 
-//getSelectStatement will return the select statement to use for this model
-func (m modelLoader) getSelectStatement(db *gorm.DB, alias string) string {
-	if alias == "" {
-		alias = m.ms.TableName(db)
+//getAlias will return the alias to use for this model, which is the table name if no alias was provided
+func (m aliasLoader) getAlias(e Executor) string {
+	if m.alias != "" {
+		return m.alias
+	}
+	return m.tableName(e)
+}
+
+//tableName will return the table of the model when run on the executor given
+func (m *modelMetadata) tableName(e Executor) string {
+	if namer, ok := e.(tableNamer); ok {
+		return namer.tableName(m.model)
+	}
+	return m.model.Table
+}
+
+//column will return the column of the selected field with the given name
+func (m *modelMetadata) column(name string) (string, bool) {
+	for _, f := range m.selectFields {
+		if f.Name == name {
+			return f.Column, true
+		}
+	}
+	return "", false
+}
+
+//getSelectStatement will return the select statement to use for this alias
+func (m aliasLoader) getSelectStatement(e Executor) string {
+	alias := m.getAlias(e)
+	if s, ok := m.selects.Load(alias); ok {
+		return s.(string)
 	}
 
 	selects := make([]string, 0, len(m.selectFields))
 	for _, f := range m.selectFields {
-		selects = append(selects, fmt.Sprintf("%s.%s", alias, f.DBName))
+		selects = append(selects, fmt.Sprintf("%s.%s", alias, f.Column))
 	}
 
-	return strings.Join(selects, ",")
+	s := strings.Join(selects, ",")
+	m.selects.Store(alias, s)
+	return s
 }
 
-func (m *modelLoader) processScan() {
-	//build key string for identity map
-	var keyVal strings.Builder
-	for i, f := range m.selectFields {
-		if !f.IsPrimaryKey {
-			continue
-		}
-		val := m.fields[i].Elem()
-		if val.IsNil() {
-			//if a PK value is nil, we should be in a failed left join, skip row
-			return
+//describeColumns will return a ScanError describing each column selected for this alias
+func (m aliasLoader) describeColumns(e Executor) []ScanError {
+	alias := m.getAlias(e)
+
+	ret := make([]ScanError, 0, len(m.selectFields))
+	for _, f := range m.selectFields {
+		ret = append(ret, ScanError{Alias: alias, Model: m.itemType.Name(), Field: f.Name, Column: f.Column})
+	}
+	return ret
+}
+
+//scanKey will return the key for the identity map of the scanned row. If every key value is nil, or any value when
+//AnyNullKeyAbsent is used, the item is absent from the row and no key is returned.
+func (m *aliasLoader) scanKey() (key, bool, error) {
+	if m.options.noDedup {
+		if m.scanNull() {
+			return nil, false, nil
 		}
-		for val.Kind() == reflect.Ptr {
-			val = val.Elem()
+		return rowKey{m.modelLoader, m.row}, true, nil
+	}
+
+	if len(m.keyIndexes) == 1 {
+		//fast path for the most common single column key
+		return keyValue(m.fields[m.keyIndexes[0]])
+	}
+
+	vals := make([]reflect.Value, 0, len(m.keyIndexes))
+	for _, i := range m.keyIndexes {
+		vals = append(vals, m.fields[i])
+	}
+	return identityKey(vals, m.options.anyNullKeyAbsent)
+}
+
+//nextRow will record that a new row was scanned, so the key of an item loaded without dedup is the same however many
+//times scanKey is called for the row
+func (m *aliasLoader) nextRow() {
+	if m.options.noDedup {
+		m.rows++
+		m.row = m.rows
+	}
+}
+
+//scanNull will report whether every column scanned for the alias is null. Fields scanned by the provider can't be
+//checked so are assumed null.
+func (m *aliasLoader) scanNull() bool {
+	for i, f := range m.selectFields {
+		if f.Scan == nil && !m.fields[i].Elem().IsNil() {
+			return false
 		}
-		keyVal.WriteString(fmt.Sprintf("[%s:%v]", f.Name, val.Interface()))
 	}
-	key := keyVal.String()
+	return true
+}
 
-	if _, ok := m.storedKeys[key]; ok {
+//processScan will store the item held by the scanned row in the identity map of the modelLoader
+func (m *aliasLoader) processScan() error {
+	k, ok, err := m.scanKey()
+	if err != nil || !ok {
+		//if the key is nil, we should be in a failed left join, skip row
+		return err
+	}
+
+	if m.root {
+		m.addRoot(k)
+	}
+	if _, ok := m.storedKeys[k]; ok {
 		//we already have this PK, skip this row
-		return
+		return nil
 	}
 
-	newItem := reflect.New(m.ms.ModelType).Elem()
+	newItem := reflect.New(m.itemType).Elem()
 
 	//go through each field we selected from
 	for i, f := range m.selectFields {
+		if f.Set != nil {
+			if err := f.Set(newItem, m.scanValues[i]); err != nil {
+				return err
+			}
+			continue
+		}
+
 		//get the value we pulled out of sql
 		selectedValue := m.fields[i].Elem()
 
 		if selectedValue.IsNil() {
-			//nil primary key means we didn't load data for this row (this code does not support nullable primary keys)
+			//null leaves the field at its zero value
 			continue
 		}
 
@@ -132,85 +350,173 @@ func (m *modelLoader) processScan() {
 		val.Set(selectedValue.Elem())
 	}
 
+	m.storedKeys[k] = len(m.items)
 	m.items = append(m.items, newItem.Addr().Interface())
-	m.storedKeys[key] = struct{}{}
+	m.keys = append(m.keys, k)
+	return nil
+}
+
+//addRoot will record the key of an item scanned for a root alias
+func (m *modelLoader) addRoot(k key) {
+	m.rooted = true
+	if m.storedRoots == nil {
+		m.storedRoots = make(map[key]struct{})
+	}
+	if _, ok := m.storedRoots[k]; ok {
+		return
+	}
+	m.storedRoots[k] = struct{}{}
+	m.rootKeys = append(m.rootKeys, k)
+}
+
+//checkOptions will return an error if options differ from those the items of m were loaded with, as items identified
+//in different ways can't share an identity map
+func (m *modelLoader) checkOptions(options modelOptions) error {
+	if !reflect.DeepEqual(m.options, options) {
+		return fmt.Errorf("model %s is already loaded with other options", m.itemType)
+	}
+	return nil
+}
+
+//merge will add all items held by other that are not already stored in m, keeping the order other loaded them
+func (m *modelLoader) merge(other *modelLoader) {
+	for i, k := range other.keys {
+		if _, ok := m.storedKeys[k]; ok {
+			continue
+		}
+
+		m.storedKeys[k] = len(m.items)
+		m.items = append(m.items, other.items[i])
+		m.keys = append(m.keys, k)
+	}
+	for _, k := range other.rootKeys {
+		m.addRoot(k)
+	}
+	m.tree = m.tree || other.tree
+	m.rooted = m.rooted || other.rooted
+}
+
+//reset will release all items held
+func (m *modelLoader) reset() {
+	m.items = nil
+	m.storedKeys = make(map[key]int)
+	m.keys = nil
+	m.children = nil
+	m.rootKeys = nil
+	m.storedRoots = nil
+}
+
+//roots will return all items not linked as the child of an item of the same type during finalize
+func (m *modelLoader) roots() []interface{} {
+	ret := make([]interface{}, 0, len(m.items)-len(m.children))
+	for _, item := range m.items {
+		if _, ok := m.children[item]; !ok {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
+
+//rootItems will return the items scanned for a root alias in the order first scanned. For trees only items not linked
+//as the child of an item of the same type are returned.
+func (m *modelLoader) rootItems() []interface{} {
+	ret := make([]interface{}, 0, len(m.rootKeys))
+	for _, k := range m.rootKeys {
+		item := m.items[m.storedKeys[k]]
+		if _, ok := m.children[item]; m.tree && ok {
+			continue
+		}
+		ret = append(ret, item)
+	}
+	return ret
 }
 
-//finalize will finalize all items and load all available relationships
-func (m *modelLoader) finalize(itemMap map[reflect.Type][]interface{}) error {
+//finalize will finalize all items and load all available relationships. Many2many relationships are linked using
+//the joinTableLoader loaded for the relationship.
+func (m *modelLoader) finalize(itemMap map[reflect.Type][]interface{}, joinMap map[joinKey]*joinTableLoader) error {
+	m.children = make(map[interface{}]struct{})
+
 	//fill all relationships we can on our items
 	for _, f := range m.relationships {
-		items, ok := itemMap[baseType(f.Struct.Type)]
+		items, ok := itemMap[f.relatedType]
 		if !ok {
 			//this relationship isn't in our item map
 			continue
 		}
 
-		lookup := make(map[string][]reflect.Value)
+		//foreignFields are the fields of the related items, and associationFields are the fields of our items, used to
+		//match this relationship
+		foreignFields := f.ForeignFields
+		associationFields := f.AssociationFields
+
+		var join *joinTableLoader
+		if f.Kind == ManyToMany {
+			if join, ok = joinMap[joinKey{baseType(m.itemType), f.Field}]; !ok {
+				//the join table wasn't loaded so we can't link this relationship
+				continue
+			}
+		}
+
+		//a relationship to our own type links parents and children of a tree
+		selfReferential := f.relatedType == baseType(m.itemType) && join == nil
+
+		lookup := make(map[key][]reflect.Value)
 
 		//construct a map with possibilities of this relationship
 		for _, n := range items {
 			itemVal := reflect.ValueOf(n).Elem()
 
 			//build a key for the attributes of this relationship
-			var sb strings.Builder
-			for i, name := range f.Relationship.ForeignFieldNames {
-				val := itemVal.FieldByName(name).Interface()
-
-				if valuer, ok := val.(driver.Valuer); ok {
-					var err error
-					val, err = valuer.Value()
-					if err != nil {
-						return err
-					}
-				}
-
-				sb.WriteString(fmt.Sprintf("[%d:%v]", i, val))
+			k, ok, err := fieldsKey(itemVal, foreignFields)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
 			}
 
-			key := sb.String()
-			lookup[key] = append(lookup[key], itemVal.Addr())
+			lookup[k] = append(lookup[k], itemVal.Addr())
 		}
 
 		//go through all models were tracking and fill in this relationship
 		for _, item := range m.items {
 			itemVal := reflect.ValueOf(item).Elem()
-			relVal := itemVal.FieldByName(f.Name)
+			relVal := itemVal.FieldByName(f.Field)
+			//clear anything linked by an earlier finalize so linking again doesn't add duplicates
+			relVal.Set(reflect.Zero(relVal.Type()))
 
 			//build a key for the attributes of this relationship
-			var sb strings.Builder
-			for i, name := range f.Relationship.AssociationForeignFieldNames {
-				val := itemVal.FieldByName(name)
-				if val.Kind() == reflect.Ptr && !val.IsNil() {
-					val = val.Elem()
-				}
-
-				keyValue := val.Interface()
-				if valuer, ok := keyValue.(driver.Valuer); ok {
-					keyValue, _ = valuer.Value()
-				}
-				sb.WriteString(fmt.Sprintf("[%d:%v]", i, keyValue))
+			k, ok, err := fieldsKey(itemVal, associationFields)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
 			}
 
-			key := sb.String()
-			//find items corresponding to this item for this relationship
-			for _, newVal := range lookup[key] {
-				//we have items to fill this relationship, fill it based on the struct
-				if relVal.Kind() == reflect.Slice {
-					//add the result to our slice
-					if relVal.Type().Elem().Kind() != reflect.Ptr {
-						//we have a slice of structs so add the struct we're pointing to
-						newVal = newVal.Elem()
+			if selfReferential {
+				if f.Kind == BelongsTo {
+					//our item references its parent
+					if len(lookup[k]) > 0 {
+						m.children[item] = struct{}{}
 					}
-
-					relVal.Set(reflect.Append(relVal, newVal))
 				} else {
-					//we don't have a slice so set the item to the first one we have and move on
-					if relVal.Type().Kind() != reflect.Ptr {
-						newVal = newVal.Elem()
+					//all matching items reference our item as their parent
+					for _, child := range lookup[k] {
+						m.children[child.Interface()] = struct{}{}
 					}
+				}
+			}
 
-					relVal.Set(newVal)
+			keys := []key{k}
+			if join != nil {
+				//our key links to the related items through the join table
+				keys = join.links[k]
+			}
+
+			//find items corresponding to this item for this relationship
+			for _, k := range keys {
+				if !setRelationship(relVal, lookup[k]) {
 					break
 				}
 			}
@@ -219,3 +525,30 @@ func (m *modelLoader) finalize(itemMap map[reflect.Type][]interface{}) error {
 
 	return nil
 }
+
+//setRelationship will fill a relationship field with the values given. If the field is not a slice it is set to the
+//first value given. The return value reports whether the field can take more values.
+func setRelationship(relVal reflect.Value, values []reflect.Value) bool {
+	for _, newVal := range values {
+		//we have items to fill this relationship, fill it based on the struct
+		if relVal.Kind() == reflect.Slice {
+			//add the result to our slice
+			if relVal.Type().Elem().Kind() != reflect.Ptr {
+				//we have a slice of structs so add the struct we're pointing to
+				newVal = newVal.Elem()
+			}
+
+			relVal.Set(reflect.Append(relVal, newVal))
+		} else {
+			//we don't have a slice so set the item to the first one we have and move on
+			if relVal.Type().Kind() != reflect.Ptr {
+				newVal = newVal.Elem()
+			}
+
+			relVal.Set(newVal)
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,110 @@
+package hydrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+)
+
+//Provider provides the metadata of models loaded by a query. Metadata is cached for each provider and model type, so
+//a provider must be comparable and always return the same metadata for a type.
+type Provider interface {
+	//Model will return the metadata of the model type given
+	Model(t reflect.Type) (*Model, error)
+}
+
+//Executor runs the statements built by a query
+type Executor interface {
+	//QueryContext will run a statement with the args given, honoring the context
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+//RelationshipKind is the kind of a relationship between two models
+type RelationshipKind string
+
+const (
+	HasOne     RelationshipKind = "has_one"
+	HasMany    RelationshipKind = "has_many"
+	BelongsTo  RelationshipKind = "belongs_to"
+	ManyToMany RelationshipKind = "many_to_many"
+)
+
+//Model is the metadata of a model needed to select, identify and link its items
+type Model struct {
+	//Type is the struct type of the model
+	Type reflect.Type
+	//Table is the table of the model, used as the alias of a model added without one
+	Table string
+	//Fields holds all fields selected for the model, in order
+	Fields []Field
+	//Relationships holds all relationships of the model that can be linked to other models
+	Relationships []Relationship
+}
+
+//Field is a field of a model loaded from a column
+type Field struct {
+	//Name is the name of the struct field
+	Name string
+	//Column is the column the field is selected from
+	Column string
+	//Type is the type of the struct field
+	Type reflect.Type
+	//PrimaryKey is set for all fields of the primary key, which identify an item
+	PrimaryKey bool
+
+	//Scan and Set can be given to control how a column is assigned to the field, ie. to decode a serialized value. Scan
+	//returns a new value the column is scanned into and Set assigns the scanned value to the field of item. If not
+	//given the column is scanned into a pointer to Type and a NULL leaves the field unset.
+	Scan func() interface{}
+	Set  func(item reflect.Value, scanned interface{}) error
+}
+
+//Relationship is a relationship of a model to another model. ForeignFields are the fields of the related model and
+//AssociationFields are the fields of the model defining the relationship, matched in order. For a BelongsTo
+//relationship the foreign fields are the keys referenced by the model defining it.
+type Relationship struct {
+	//Field is the name of the struct field holding the related items
+	Field string
+	Kind  RelationshipKind
+
+	ForeignFields     []string
+	AssociationFields []string
+
+	//JoinTable links both models of a ManyToMany relationship
+	JoinTable *JoinTable
+}
+
+//JoinTable is the join table of a ManyToMany relationship. SourceColumns reference the AssociationFields and
+//DestinationColumns reference the ForeignFields of the relationship, in order.
+type JoinTable struct {
+	Table              string
+	SourceColumns      []string
+	DestinationColumns []string
+}
+
+//tableNamer is implemented by executors resolving table names that are only known while running, such as gorm whose
+//table names can depend on the db. Names returned take precedence over the Table of the metadata.
+type tableNamer interface {
+	tableName(m *Model) string
+	joinTableName(m *Model, relationship string) string
+}
+
+//relationship will return the relationship of a model held by the field with the given name
+func (m *Model) relationship(name string) (Relationship, bool) {
+	for _, r := range m.Relationships {
+		if r.Field == name {
+			return r, true
+		}
+	}
+	return Relationship{}, false
+}
+
+//fieldType will return the type of the struct field of a model with the given name
+func (m *Model) fieldType(name string) (reflect.Type, error) {
+	f, ok := m.Type.FieldByName(name)
+	if !ok {
+		return nil, fmt.Errorf("%s has no field %s", m.Type, name)
+	}
+	return f.Type, nil
+}
@@ -0,0 +1,280 @@
+package hydrate
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+//Result holds everything loaded by a run, returned by RunResult. Items are finalized when the result is created, and
+//can be read using All, ByKey and Count, or used to fill outputs any number of times with Fill.
+type Result struct {
+	loaders []*modelLoader
+	joins   []*joinTableLoader
+	//items holds the items output for each type by the last finalize
+	items map[reflect.Type][]interface{}
+}
+
+//newResult will create a result holding the loaders given, finalizing all items
+func newResult(loaders []*modelLoader, joins []*joinTableLoader) (*Result, error) {
+	ret := &Result{loaders: loaders, joins: joins}
+	if err := ret.Finalize(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+//Finalize will link all relationships between the items held again. Relationships linked by an earlier finalize are
+//cleared first, so it can be called any number of times, ie. after items are added by Merge.
+func (res *Result) Finalize() error {
+	items, err := finalizeOutput(res.loaders, res.joins)
+	if err != nil {
+		return err
+	}
+
+	res.items = items
+	return nil
+}
+
+//RunInto will run the query loading into an existing result, ie. to conditionally load more of a hierarchy after a
+//first query. New items are merged into the identity maps of the result, so items already held are kept, and the
+//result is finalized again so relationships of items already read from the result are filled in place. A batch query
+//loads for the items held by the result. Items are only merged once the query has succeeded, so the result is
+//unchanged if it returns an error.
+func (r Query) RunInto(ctx context.Context, res *Result) error {
+	loaded := &Result{}
+	if err := loaded.load(ctx, r, res); err != nil {
+		return err
+	}
+
+	return res.Merge(loaded)
+}
+
+//RunInto will run all queries in order loading into an existing result, as with Query.RunInto. Items are only merged
+//once every query has succeeded.
+func (m MultiQuery) RunInto(ctx context.Context, res *Result) error {
+	loaded := &Result{}
+	for i, q := range m {
+		if err := loaded.load(ctx, q, res); err != nil {
+			return fmt.Errorf("multi query %d: %w", i, err)
+		}
+	}
+
+	return res.Merge(loaded)
+}
+
+//load will run a query using the loaders of the result, adding loaders for any types not yet held. Relationships are
+//not linked. If held is given the query is loaded to be merged into it, so models must use the options of the loaders
+//held and batch queries load for the items of both results.
+func (res *Result) load(ctx context.Context, q Query, held *Result) error {
+	if err := q.Validate(); err != nil {
+		return err
+	}
+	for _, model := range q.models {
+		t := baseType(reflect.TypeOf(model.example))
+		if held != nil {
+			if l := held.loader(t); l != nil {
+				if err := l.checkOptions(model.options); err != nil {
+					return err
+				}
+			}
+		}
+		if l := res.loader(t); l != nil {
+			if err := l.checkOptions(model.options); err != nil {
+				return err
+			}
+			continue
+		}
+		l, err := newModelLoader(q.provider, model.example, model.options)
+		if err != nil {
+			return err
+		}
+		res.loaders = append(res.loaders, l)
+	}
+	for _, table := range q.joinTables {
+		if res.join(table.key()) == nil {
+			j, err := newJoinTableLoader(q.provider, table.example, table.relationship)
+			if err != nil {
+				return err
+			}
+			res.joins = append(res.joins, j)
+		}
+	}
+
+	//pull loaders from the result instead of creating new ones
+	q.getAliasLoader = func(models []modelConfiguration) ([]*aliasLoader, error) {
+		ret := make([]*aliasLoader, 0, len(models))
+		for _, m := range models {
+			ret = append(ret, res.loader(baseType(reflect.TypeOf(m.example))).newAliasLoader(m.alias))
+		}
+		return ret, nil
+	}
+	q.getJoinTableLoader = func(tables []joinTableConfiguration) ([]*joinTableLoader, []string, error) {
+		ret := make([]*joinTableLoader, 0, len(tables))
+		aliases := make([]string, 0, len(tables))
+		for _, t := range tables {
+			ret = append(ret, res.join(t.key()))
+			aliases = append(aliases, t.alias)
+		}
+		return ret, aliases, nil
+	}
+
+	queries := []Query{q}
+	if q.batch != nil {
+		t := baseType(reflect.TypeOf(q.batch.parent))
+		parents := res.loader(t)
+		if h := held.loader(t); h != nil {
+			//load for the items of both results, keys held by both are only bound once
+			items := h.items[:len(h.items):len(h.items)]
+			if parents != nil {
+				items = append(items, parents.items...)
+			}
+			parents = &modelLoader{modelMetadata: h.modelMetadata, items: items}
+		}
+		if parents == nil {
+			return fmt.Errorf("no model of type %T loaded by an earlier query", q.batch.parent)
+		}
+		var err error
+		if queries, err = q.batches(parents); err != nil {
+			return err
+		}
+	}
+	for _, q := range queries {
+		if _, _, err := q.runQuery(ctx, processRow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Fill will fill outputs with the items held, as with Query.Run
+func (res *Result) Fill(output ...interface{}) error {
+	return fillItems(res.loaders, res.items, output)
+}
+
+//Merge will add all items and join table links held by other that are not already held, then finalize the result
+//again so relationships are linked across both results. Items already held are kept over those of other. Models held
+//by both results must have been loaded with the same options, otherwise an error is returned and nothing is merged.
+func (res *Result) Merge(other *Result) error {
+	for _, l := range other.loaders {
+		if shared := res.loader(l.itemType); shared != nil {
+			if err := shared.checkOptions(l.options); err != nil {
+				return err
+			}
+		}
+	}
+	for _, l := range other.loaders {
+		if shared := res.loader(l.itemType); shared != nil {
+			shared.merge(l)
+			continue
+		}
+		res.loaders = append(res.loaders, l)
+	}
+	for _, j := range other.joins {
+		if shared := res.join(j.key); shared != nil {
+			shared.merge(j)
+			continue
+		}
+		res.joins = append(res.joins, j)
+	}
+
+	return res.Finalize()
+}
+
+//loader will return the loader of a model type, or nil if the type wasn't loaded or res is nil
+func (res *Result) loader(t reflect.Type) *modelLoader {
+	if res == nil {
+		return nil
+	}
+	for _, l := range res.loaders {
+		if l.itemType == t {
+			return l
+		}
+	}
+	return nil
+}
+
+//join will return the loader of a join table, or nil if it wasn't loaded
+func (res *Result) join(k joinKey) *joinTableLoader {
+	for _, j := range res.joins {
+		if j.key == k {
+			return j
+		}
+	}
+	return nil
+}
+
+//ResultRunner is a query that can be run into a Result, such as a Query, MultiQuery or Builder
+type ResultRunner interface {
+	RunResult(ctx context.Context) (*Result, error)
+}
+
+//Load will run q and return the items of type T it outputs, as with All. An error is returned if no model of type T
+//was added to q.
+func Load[T any](ctx context.Context, q ResultRunner) ([]*T, error) {
+	res, err := q.RunResult(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if t := reflect.TypeOf((*T)(nil)).Elem(); res.loader(t) == nil {
+		return nil, fmt.Errorf("no model of type %s added to query", t)
+	}
+
+	return All[T](res), nil
+}
+
+//LoadOne will run q and return the first item of type T it outputs, or nil if none were loaded. As with Run no limit
+//is added to the query.
+func LoadOne[T any](ctx context.Context, q ResultRunner) (*T, error) {
+	items, err := Load[T](ctx, q)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+
+	return items[0], nil
+}
+
+//All will return the items of type T output by the result, in the order they were loaded. As with Run this respects
+//AsRoot and Tree.
+func All[T any](res *Result) []*T {
+	items := res.items[reflect.TypeOf((*T)(nil)).Elem()]
+	ret := make([]*T, 0, len(items))
+	for _, i := range items {
+		ret = append(ret, i.(*T))
+	}
+	return ret
+}
+
+//ByKey will return the item of type T with the given primary key, which is one value for each primary key field in
+//the order they are defined. Values are compared as they are in the identity map, so any integer type matches an
+//integer key, and nil matches a null part of a composite key. All items loaded for T are found, not only those output.
+func ByKey[T any](res *Result, keys ...interface{}) (*T, bool, error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	l := res.loader(t)
+	if l == nil {
+		return nil, false, nil
+	}
+	if len(keys) != len(l.keyFields) {
+		return nil, false, fmt.Errorf("%s has %d primary key fields, got %d values", t, len(l.keyFields), len(keys))
+	}
+
+	vals := make([]reflect.Value, 0, len(keys))
+	for _, k := range keys {
+		vals = append(vals, reflect.ValueOf(k))
+	}
+	k, ok, err := identityKey(vals, l.options.anyNullKeyAbsent)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	i, ok := l.storedKeys[k]
+	if !ok {
+		return nil, false, nil
+	}
+	return l.items[i].(*T), true, nil
+}
+
+//Count will return the number of items of type T output by the result
+func Count[T any](res *Result) int {
+	return len(res.items[reflect.TypeOf((*T)(nil)).Elem()])
+}
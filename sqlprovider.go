@@ -0,0 +1,263 @@
+package hydrate
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jinzhu/inflection"
+)
+
+//NewSQLQuery will create a query running on a *sql.DB, *sql.Tx or any other Executor, loading the metadata of models
+//from hydrate struct tags using TagProvider. Args are passed to the driver as given, slices are not expanded.
+func NewSQLQuery(e Executor, query string, args ...interface{}) Query {
+	return NewQueryWith(TagProvider{}, e, query, args...)
+}
+
+//TagProvider is a Provider loading the metadata of models from `hydrate` struct tags, independent of gorm. Options
+//are separated by semicolons:
+//	pk                      the field is part of the primary key
+//	column=name             the column of the field, by default the snake case of the field name
+//	-                       the field is ignored
+//	rel=Fields:Fields       the field holds a relationship, matching fields of the model to fields of the related
+//	                        model, each list separated by commas
+//	kind=has_one            the kind of the relationship, by default has_one or has_many if the fields of the model
+//	                        are its primary key and belongs_to otherwise
+//	join=table              the join table of a many_to_many relationship
+//	join_columns=cols:cols  the columns of the join table referencing each side of a many_to_many relationship
+//Fields are selected if they have a column option or hold a value that can be scanned. The table of a model is given
+//by a TableName() string method, or the plural snake case of the type name.
+//	type Textbook struct {
+//		TextbookID uint `hydrate:"pk"`
+//		AuthorID   *uint
+//		Author     *Author    `hydrate:"rel=AuthorID:AuthorID"`
+//		Sections   []*Section `hydrate:"rel=TextbookID:TextbookID"`
+//		Tags       []*Tag     `hydrate:"rel=TextbookID:TagID;join=textbook_tags;join_columns=textbook_id:tag_id"`
+//	}
+type TagProvider struct{}
+
+//tabler is implemented by models defining their table name
+type tabler interface {
+	TableName() string
+}
+
+var (
+	scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+	timeType    = reflect.TypeOf(time.Time{})
+)
+
+//Model will return the metadata of a model from its struct tags
+func (p TagProvider) Model(t reflect.Type) (*Model, error) {
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("type %s is not a struct", t)
+	}
+
+	ret := Model{Type: t}
+	if tabler, ok := reflect.New(t).Interface().(tabler); ok {
+		ret.Table = tabler.TableName()
+	} else {
+		ret.Table = inflection.Plural(snakeCase(t.Name()))
+	}
+
+	if err := p.addFields(&ret, t); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+//addFields will add the fields and relationships of a struct type to a model, including fields of embedded structs
+func (p TagProvider) addFields(m *Model, t reflect.Type) error {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		options, err := parseTag(f.Tag.Get("hydrate"))
+		if err != nil {
+			return fmt.Errorf("%s.%s: %w", m.Type, f.Name, err)
+		}
+		if _, ok := options["-"]; ok {
+			continue
+		}
+
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && len(options) == 0 && !scannable(f.Type) {
+			//fields of embedded structs are promoted
+			if err := p.addFields(m, f.Type); err != nil {
+				return err
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			//unexported
+			continue
+		}
+
+		if rel, ok := options["rel"]; ok {
+			r, err := tagRelationship(m.Type, f, rel, options)
+			if err != nil {
+				return fmt.Errorf("%s.%s: %w", m.Type, f.Name, err)
+			}
+			m.Relationships = append(m.Relationships, r)
+			continue
+		}
+
+		column, ok := options["column"]
+		if !ok {
+			if !scannable(f.Type) {
+				continue
+			}
+			column = snakeCase(f.Name)
+		}
+		_, pk := options["pk"]
+
+		m.Fields = append(m.Fields, Field{Name: f.Name, Column: column, Type: f.Type, PrimaryKey: pk})
+	}
+
+	return nil
+}
+
+//tagRelationship will build the relationship of a field from its tag options
+func tagRelationship(modelType reflect.Type, f reflect.StructField, rel string, options map[string]string) (Relationship, error) {
+	ret := Relationship{Field: f.Name}
+
+	var err error
+	if ret.AssociationFields, ret.ForeignFields, err = splitPair(rel); err != nil {
+		return Relationship{}, fmt.Errorf("rel %w", err)
+	}
+	relatedType := baseType(f.Type)
+	if relatedType.Kind() != reflect.Struct {
+		return Relationship{}, fmt.Errorf("rel must be on a struct field, %s is not a struct", relatedType)
+	}
+	for _, name := range ret.AssociationFields {
+		if _, ok := modelType.FieldByName(name); !ok {
+			return Relationship{}, fmt.Errorf("%s has no field %s", modelType, name)
+		}
+	}
+	for _, name := range ret.ForeignFields {
+		if _, ok := relatedType.FieldByName(name); !ok {
+			return Relationship{}, fmt.Errorf("%s has no field %s", relatedType, name)
+		}
+	}
+
+	if table, ok := options["join"]; ok {
+		ret.Kind = ManyToMany
+		ret.JoinTable = &JoinTable{Table: table}
+		if ret.JoinTable.SourceColumns, ret.JoinTable.DestinationColumns, err = splitPair(options["join_columns"]); err != nil {
+			return Relationship{}, fmt.Errorf("join_columns %w", err)
+		}
+		if len(ret.JoinTable.SourceColumns) != len(ret.AssociationFields) {
+			return Relationship{}, fmt.Errorf("join_columns must have a column for each field of rel")
+		}
+		return ret, nil
+	}
+
+	if kind, ok := options["kind"]; ok {
+		ret.Kind = RelationshipKind(kind)
+		switch ret.Kind {
+		case HasOne, HasMany, BelongsTo:
+		default:
+			return Relationship{}, fmt.Errorf("unknown relationship kind %s", kind)
+		}
+		return ret, nil
+	}
+
+	//a relationship from our primary key is held by the related model, otherwise we hold the key of the related model
+	ret.Kind = BelongsTo
+	if primaryKey(modelType, ret.AssociationFields) {
+		ret.Kind = HasOne
+		if f.Type.Kind() == reflect.Slice {
+			ret.Kind = HasMany
+		}
+	}
+	return ret, nil
+}
+
+//primaryKey will report whether all fields of a type with the given names are tagged as part of the primary key
+func primaryKey(t reflect.Type, names []string) bool {
+	for _, name := range names {
+		f, _ := t.FieldByName(name)
+		options, _ := parseTag(f.Tag.Get("hydrate"))
+		if _, ok := options["pk"]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+//parseTag will parse the options of a hydrate tag
+func parseTag(tag string) (map[string]string, error) {
+	ret := make(map[string]string)
+	for _, option := range strings.Split(tag, ";") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		kv := strings.SplitN(option, "=", 2)
+		switch kv[0] {
+		case "pk", "-":
+			ret[kv[0]] = ""
+		case "column", "rel", "kind", "join", "join_columns":
+			if len(kv) != 2 || kv[1] == "" {
+				return nil, fmt.Errorf("option %s must have a value", kv[0])
+			}
+			ret[kv[0]] = strings.TrimSpace(kv[1])
+		default:
+			return nil, fmt.Errorf("unknown option %s", kv[0])
+		}
+	}
+	return ret, nil
+}
+
+//splitPair will split a pair of comma separated lists separated by a colon, ie. `A,B:C,D`. Both lists must be the
+//same length.
+func splitPair(pair string) ([]string, []string, error) {
+	sides := strings.Split(pair, ":")
+	if len(sides) != 2 {
+		return nil, nil, fmt.Errorf("%q must be two lists separated by a colon", pair)
+	}
+	left, right := strings.Split(sides[0], ","), strings.Split(sides[1], ",")
+	if len(left) != len(right) {
+		return nil, nil, fmt.Errorf("%q must have the same number of values on each side", pair)
+	}
+	for i := range left {
+		left[i], right[i] = strings.TrimSpace(left[i]), strings.TrimSpace(right[i])
+	}
+	return left, right, nil
+}
+
+//scannable will report whether a value of a type can be scanned from a column
+func scannable(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType || reflect.PtrTo(t).Implements(scannerType) {
+		return true
+	}
+
+	switch t.Kind() {
+	case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.Uint8
+	}
+	return false
+}
+
+//snakeCase will convert a field or type name to snake case, keeping initialisms together (ie. TextbookID is textbook_id)
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var sb strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+				(i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+				sb.WriteRune('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
@@ -0,0 +1,74 @@
+package hydrate
+
+import (
+	"fmt"
+	"strings"
+)
+
+//BranchColumn is selected by each branch of a union query with the index of the branch, so each row is only loaded
+//into the models of the branch it came from
+const BranchColumn = "hydrate_branch"
+
+//queryBranch is one SELECT of a union query, built by Builder.Union
+type queryBranch struct {
+	//query is the statement following the columns selected by the branch, as with NewQuery. It must join every alias
+	//of the query, with NULL columns for the models the branch doesn't load.
+	query string
+	args  []interface{}
+	//models and joinTables hold the index of each model and join table configuration loaded by the branch
+	models     []int
+	joinTables []int
+}
+
+//unionStatement will return the statement selecting every branch with UNION ALL and the args of all branches. All
+//branches select the same columns, named by their position so they can be ordered. Rows are ordered by branch, then
+//by the primary key of each model.
+func (r Query) unionStatement(aliasLoaders []*aliasLoader, joins []*joinTableLoader, joinAliases []string) (string, []interface{}) {
+	var columns []ScanError
+	orders := []string{BranchColumn}
+	for _, l := range aliasLoaders {
+		for _, i := range l.keyIndexes {
+			orders = append(orders, fmt.Sprintf("c%d", len(columns)+i))
+		}
+		columns = append(columns, l.describeColumns(r.executor)...)
+	}
+	for i, j := range joins {
+		columns = append(columns, j.describeColumns(r.executor, joinAliases[i])...)
+	}
+
+	selects := make([]string, len(columns))
+	for i, c := range columns {
+		selects[i] = fmt.Sprintf("%s.%s AS c%d", c.Alias, c.Column, i)
+	}
+	selected := strings.Join(selects, ",")
+
+	branches := make([]string, 0, len(r.branches))
+	var args []interface{}
+	for b, branch := range r.branches {
+		branches = append(branches, fmt.Sprintf("SELECT %d AS %s,%s %s", b, BranchColumn, selected, branch.query))
+		args = append(args, branch.args...)
+	}
+
+	return fmt.Sprintf("%s ORDER BY %s", strings.Join(branches, " UNION ALL "), strings.Join(orders, ", ")), args
+}
+
+//branchProcess will wrap process so only the loaders of the branch scanned into branch are given each row
+func (r Query) branchProcess(branch *int64, aliasLoaders []*aliasLoader, joins []*joinTableLoader, process func([]*aliasLoader, []*joinTableLoader) error) func([]*aliasLoader, []*joinTableLoader) error {
+	branchLoaders := make([][]*aliasLoader, len(r.branches))
+	branchJoins := make([][]*joinTableLoader, len(r.branches))
+	for b, branch := range r.branches {
+		for _, i := range branch.models {
+			branchLoaders[b] = append(branchLoaders[b], aliasLoaders[i])
+		}
+		for _, i := range branch.joinTables {
+			branchJoins[b] = append(branchJoins[b], joins[i])
+		}
+	}
+
+	return func([]*aliasLoader, []*joinTableLoader) error {
+		if *branch < 0 || *branch >= int64(len(r.branches)) {
+			return fmt.Errorf("row has unknown branch %d", *branch)
+		}
+		return process(branchLoaders[*branch], branchJoins[*branch])
+	}
+}
@@ -0,0 +1,108 @@
+package hydrate
+
+import (
+	"fmt"
+	"reflect"
+)
+
+//Validate will check the configuration of the query without running it. Models must be structs with a primary key,
+//unless they use NaturalKey or NoDedup, every alias of a model must have the same options, each field of their
+//relationships must exist, join tables must be of a many2many relationship, and every alias must be unique within the
+//query. A template query can't use WithRecursive, as the template holds the full statement. Validate is run by Run and
+//all other ways of running a query.
+func (r Query) Validate() error {
+	if r.template && r.cte != "" {
+		return fmt.Errorf("template queries can not use WithRecursive, add the cte to the template instead")
+	}
+
+	aliases := make(map[string]string)
+	addAlias := func(alias string, name string) error {
+		if other, ok := aliases[alias]; ok {
+			if other == name {
+				return fmt.Errorf("alias %s is added more than once for %s", alias, name)
+			}
+			return fmt.Errorf("alias %s is used by both %s and %s", alias, other, name)
+		}
+		aliases[alias] = name
+		return nil
+	}
+
+	options := make(map[reflect.Type]modelOptions)
+	for _, m := range r.models {
+		if m.example == nil {
+			return fmt.Errorf("model added with alias %s is nil", m.alias)
+		}
+		t := baseType(reflect.TypeOf(m.example))
+		if t.Kind() != reflect.Struct {
+			return fmt.Errorf("model %T is not a struct", m.example)
+		}
+
+		metadata, err := getModelMetadata(r.provider, m.example)
+		if err != nil {
+			return fmt.Errorf("model %s: %w", t, err)
+		}
+		if other, ok := options[t]; ok && !reflect.DeepEqual(other, m.options) {
+			return fmt.Errorf("model %s is added with conflicting options", t)
+		}
+		options[t] = m.options
+		if len(m.options.naturalKey) > 0 {
+			if _, _, err := metadata.naturalKey(m.options.naturalKey); err != nil {
+				return err
+			}
+		} else if len(metadata.keyFields) == 0 && !m.options.noDedup {
+			return fmt.Errorf("model %s has no primary key, use NaturalKey or NoDedup to load it", t)
+		}
+		for _, rel := range metadata.relationships {
+			if err := validateRelationship(t, rel); err != nil {
+				return err
+			}
+		}
+
+		alias := m.alias
+		if alias == "" {
+			alias = metadata.tableName(r.executor)
+		}
+		if err := addAlias(alias, t.String()); err != nil {
+			return err
+		}
+	}
+
+	for _, j := range r.joinTables {
+		if j.example == nil {
+			return fmt.Errorf("join table added with alias %s has a nil model", j.alias)
+		}
+		t := baseType(reflect.TypeOf(j.example))
+		if t.Kind() != reflect.Struct {
+			return fmt.Errorf("join table model %T is not a struct", j.example)
+		}
+
+		metadata, err := getJoinTableMetadata(r.provider, j.example, j.relationship)
+		if err != nil {
+			return fmt.Errorf("join table %s.%s: %w", t, j.relationship, err)
+		}
+		if err := addAlias(metadata.getAlias(r.executor, j.alias), fmt.Sprintf("join table %s.%s", t, j.relationship)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//validateRelationship will check that the related model is a struct and every field of a relationship exists on its
+//side of the relationship
+func validateRelationship(t reflect.Type, rel relationshipMetadata) error {
+	if rel.relatedType.Kind() != reflect.Struct {
+		return fmt.Errorf("relationship %s.%s: %s is not a struct", t, rel.Field, rel.relatedType)
+	}
+	for _, name := range rel.AssociationFields {
+		if _, ok := t.FieldByName(name); !ok {
+			return fmt.Errorf("relationship %s.%s: %s has no field %s", t, rel.Field, t, name)
+		}
+	}
+	for _, name := range rel.ForeignFields {
+		if _, ok := rel.relatedType.FieldByName(name); !ok {
+			return fmt.Errorf("relationship %s.%s: %s has no field %s", t, rel.Field, rel.relatedType, name)
+		}
+	}
+	return nil
+}